@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/prometheus/common/log"
+)
+
+// Admin API served on the web listener, every request has to carry the
+// configured token as "Authorization: Bearer <token>"
+
+const (
+	SPRebirthAPIPath string = "/api/v1/rebirth"
+)
+
+type rebirthResult struct {
+	Namespace string `json:"namespace"`
+	Group     string `json:"group"`
+	Node      string `json:"node"`
+	Sent      bool   `json:"sent"`
+}
+
+type apiResponse struct {
+	Status  string          `json:"status"`
+	Error   string          `json:"error,omitempty"`
+	Results []rebirthResult `json:"results,omitempty"`
+}
+
+func writeAPIResponse(w http.ResponseWriter, code int,
+	response apiResponse) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Warnf("Error writing API response: %v\n", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, code int, message string) {
+	writeAPIResponse(w, code, apiResponse{Status: "error", Error: message})
+}
+
+// Wrap an API handler with the token check and the allowed method
+func apiHandler(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(token),
+			[]byte(*adminToken)) != 1 {
+			log.Warnf("Unauthorized %s %s from %s\n", r.Method, r.URL.Path,
+				r.RemoteAddr)
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeAPIError(w, http.StatusMethodNotAllowed,
+				"method not allowed")
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// The API is only available once a token has been configured
+func registerAPIHandlers(mux *http.ServeMux) {
+	if *adminToken == "" {
+		log.Infof("No --web.admin-token given, admin API disabled\n")
+		return
+	}
+
+	mux.HandleFunc(SPRebirthAPIPath,
+		apiHandler(http.MethodPost, rebirthAPIHandler))
+
+	mux.HandleFunc(SPCommandAPIPath,
+		apiHandler(http.MethodPost, commandAPIHandler))
+}
+
+// POST /api/v1/rebirth?group=<group>&node=<node>[&namespace=<namespace>]
+//
+// Group and node are glob patterns (* matches everything) matched against the
+// known edge nodes.  A node that has not been seen yet can be named
+// explicitly, it is then assumed to use the given (or spBv1.0) namespace.
+func rebirthAPIHandler(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	nodeID := r.URL.Query().Get("node")
+	namespace := r.URL.Query().Get("namespace")
+
+	if group == "" || nodeID == "" {
+		writeAPIError(w, http.StatusBadRequest,
+			"group and node are required")
+		return
+	}
+
+	if _, err := path.Match(group, ""); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid group pattern")
+		return
+	}
+
+	if _, err := path.Match(nodeID, ""); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid node pattern")
+		return
+	}
+
+	var targets []rebirthResult
+
+	mutex.RLock()
+
+	for _, node := range edgeNodeList {
+		groupMatch, _ := path.Match(group, node.group)
+		nodeMatch, _ := path.Match(nodeID, node.nodeID)
+
+		if groupMatch && nodeMatch &&
+			(namespace == "" || namespace == node.namespace) {
+			targets = append(targets, rebirthResult{
+				Namespace: node.namespace,
+				Group:     node.group,
+				Node:      node.nodeID,
+			})
+		}
+	}
+
+	mutex.RUnlock()
+
+	isPattern := strings.ContainsAny(group+nodeID, "*?[")
+
+	if len(targets) == 0 && !isPattern {
+		if namespace == "" {
+			namespace = SPNamespaceV3
+		}
+
+		topic := newNodeTopic(namespace, group, msgNCMD, nodeID)
+
+		if _, err := parseTopic(topic.String()); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		targets = append(targets, rebirthResult{
+			Namespace: namespace,
+			Group:     group,
+			Node:      nodeID,
+		})
+	}
+
+	if len(targets) == 0 {
+		writeAPIError(w, http.StatusNotFound, "no matching edge node")
+		return
+	}
+
+	code := http.StatusOK
+	status := "success"
+
+	// Publishing waits on the broker and the rebirth rate limit, the
+	// exporter lock must not be held
+	for index := range targets {
+		target := &targets[index]
+
+		log.Infof("Manual rebirth of %s/%s requested by %s\n", target.Group,
+			target.Node, r.RemoteAddr)
+
+		target.Sent = exporter.rebirth.sendNow(target.Namespace,
+			target.Group, target.Node)
+
+		if !target.Sent {
+			code = http.StatusBadGateway
+			status = "error"
+		}
+	}
+
+	writeAPIResponse(w, code, apiResponse{Status: status, Results: targets})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+)
+
+// Historical metrics replayed by store and forward edge nodes can be
+// collected into OpenMetrics files instead of the live series, ready for
+// promtool tsdb create-blocks-from openmetrics.  Samples are buffered and
+// written to a new file in the backfill directory every interval.
+
+type backfillSink struct {
+	mutex    sync.Mutex
+	dir      string
+	families map[string]*backfillFamily
+}
+
+type backfillFamily struct {
+	help   string
+	series map[uint64]*backfillSeries
+}
+
+type backfillSeries struct {
+	labelValues prometheus.Labels
+	samples     []backfillSample
+}
+
+type backfillSample struct {
+	value     float64
+	timestamp time.Time
+}
+
+func newBackfillSink(dir string) *backfillSink {
+	return &backfillSink{
+		dir:      dir,
+		families: make(map[string]*backfillFamily),
+	}
+}
+
+func (b *backfillSink) add(metricName string, help string,
+	labelValues prometheus.Labels, value float64, timestamp time.Time) {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	family, exists := b.families[metricName]
+
+	if !exists {
+		family = &backfillFamily{
+			help:   help,
+			series: make(map[uint64]*backfillSeries),
+		}
+		b.families[metricName] = family
+	}
+
+	signature := model.LabelsToSignature(labelValues)
+	series, exists := family.series[signature]
+
+	if !exists {
+		series = &backfillSeries{labelValues: labelValues}
+		family.series[signature] = series
+	}
+
+	series.samples = append(series.samples, backfillSample{
+		value:     value,
+		timestamp: timestamp,
+	})
+}
+
+// Flush the buffered samples every interval, until the process exits
+func (b *backfillSink) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := b.flush(); err != nil {
+			log.Errorf("Error writing backfill file: %v\n", err)
+		}
+	}
+}
+
+// Write everything buffered so far to a new file.  It is written under a
+// temporary name first so a half written file is never picked up.
+func (b *backfillSink) flush() error {
+	b.mutex.Lock()
+	families := b.families
+	b.families = make(map[string]*backfillFamily)
+	b.mutex.Unlock()
+
+	if len(families) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return err
+	}
+
+	name := filepath.Join(b.dir, fmt.Sprintf("backfill-%d.om",
+		time.Now().UnixNano()/int64(time.Millisecond)))
+	tmpName := name + ".tmp"
+
+	file, err := os.Create(tmpName)
+
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	writeOpenMetrics(writer, families)
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	log.Infof("Wrote backfill file %s\n", name)
+
+	return os.Rename(tmpName, name)
+}
+
+// OpenMetrics wants the samples of a family together and those of a series
+// in order of time, families and series are sorted to keep files stable
+func writeOpenMetrics(writer *bufio.Writer,
+	families map[string]*backfillFamily) {
+
+	var names []string
+
+	for name := range families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := families[name]
+
+		fmt.Fprintf(writer, "# HELP %s %s\n", name,
+			escapeOpenMetrics(family.help))
+		fmt.Fprintf(writer, "# TYPE %s gauge\n", name)
+
+		var seriesList []*backfillSeries
+
+		for _, series := range family.series {
+			seriesList = append(seriesList, series)
+		}
+
+		sort.Slice(seriesList, func(i, j int) bool {
+			return formatOpenMetricsLabels(seriesList[i].labelValues) <
+				formatOpenMetricsLabels(seriesList[j].labelValues)
+		})
+
+		for _, series := range seriesList {
+			labels := formatOpenMetricsLabels(series.labelValues)
+
+			sort.SliceStable(series.samples, func(i, j int) bool {
+				return series.samples[i].timestamp.Before(
+					series.samples[j].timestamp)
+			})
+
+			for _, sample := range series.samples {
+				fmt.Fprintf(writer, "%s%s %s %s\n", name, labels,
+					strconv.FormatFloat(sample.value, 'g', -1, 64),
+					strconv.FormatFloat(float64(sample.timestamp.UnixNano())/
+						float64(time.Second), 'f', 3, 64))
+			}
+		}
+	}
+
+	fmt.Fprintf(writer, "# EOF\n")
+}
+
+func formatOpenMetricsLabels(labelValues prometheus.Labels) string {
+	var labels []string
+
+	for label, value := range labelValues {
+		if value != "" {
+			labels = append(labels,
+				label+"=\""+escapeOpenMetrics(value)+"\"")
+		}
+	}
+
+	if len(labels) == 0 {
+		return ""
+	}
+
+	sort.Strings(labels)
+
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func escapeOpenMetrics(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
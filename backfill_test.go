@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWriteOpenMetrics(t *testing.T) {
+	at := func(seconds float64) time.Time {
+		return time.Unix(0, int64(seconds*float64(time.Second)))
+	}
+
+	sink := newBackfillSink("")
+
+	// Out of order across families, series and samples
+	sink.add("Voltage", SPDefaultHelp, prometheus.Labels{SPGroupID: "G1",
+		SPDeviceID: ""}, 230, at(1600000000))
+	sink.add("Temp", "Inlet \"A\"\nin \\degC", prometheus.Labels{
+		SPGroupID: "G1", "site": "B"}, 21.5, at(1600000060.25))
+	sink.add("Temp", "", prometheus.Labels{SPGroupID: "G1",
+		"site": "A \"north\"\\1\n"}, 20, at(1600000000))
+	sink.add("Temp", "", prometheus.Labels{SPGroupID: "G1", "site": "B"}, 21,
+		at(1600000000.5))
+	sink.add("Empty", SPDefaultHelp, prometheus.Labels{SPDeviceID: ""}, 1,
+		at(1600000000))
+
+	want := `# HELP Empty Metric pushed via MQTT
+# TYPE Empty gauge
+Empty 1 1600000000.000
+# HELP Temp Inlet \"A\"\nin \\degC
+# TYPE Temp gauge
+Temp{site="A \"north\"\\1\n",sp_group_id="G1"} 20 1600000000.000
+Temp{site="B",sp_group_id="G1"} 21 1600000000.500
+Temp{site="B",sp_group_id="G1"} 21.5 1600000060.250
+# HELP Voltage Metric pushed via MQTT
+# TYPE Voltage gauge
+Voltage{sp_group_id="G1"} 230 1600000000.000
+# EOF
+`
+
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+
+	writeOpenMetrics(writer, sink.families)
+
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := buffer.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	"github.com/prometheus/common/log"
+)
+
+// Command (NCMD / DCMD) write API.  A metric can only be written once its
+// edge node or device has declared it in a birth certificate, with the same
+// data type, and when its name is on the allowlist.
+
+const (
+	SPCommandAPIPath string = "/api/v1/command"
+)
+
+var sparkplugDatatypes = map[string]uint32{
+	"Int8":     PBInt8,
+	"Int16":    PBInt16,
+	"Int32":    PBInt32,
+	"Int64":    PBInt64,
+	"UInt8":    PBUInt8,
+	"UInt16":   PBUInt16,
+	"UInt32":   PBUInt32,
+	"UInt64":   PBUInt64,
+	"Float":    PBFloat,
+	"Double":   PBDouble,
+	"Boolean":  PBBoolean,
+	"String":   PBString,
+	"DateTime": PBDateTime,
+	"Text":     PBText,
+	"UUID":     PBUUID,
+}
+
+var (
+	commandAllowlist []*regexp.Regexp
+	auditMutex       sync.Mutex
+)
+
+type commandRequest struct {
+	Namespace string          `json:"namespace"`
+	Group     string          `json:"group"`
+	Node      string          `json:"node"`
+	Device    string          `json:"device,omitempty"`
+	Metric    string          `json:"metric"`
+	Datatype  string          `json:"datatype"`
+	Value     json.RawMessage `json:"value"`
+}
+
+type commandAudit struct {
+	Time     time.Time       `json:"time"`
+	Remote   string          `json:"remote"`
+	Group    string          `json:"group"`
+	Node     string          `json:"node"`
+	Device   string          `json:"device,omitempty"`
+	Topic    string          `json:"topic,omitempty"`
+	Metric   string          `json:"metric"`
+	Datatype string          `json:"datatype"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	Sent     bool            `json:"sent"`
+	Outcome  string          `json:"outcome"`
+}
+
+// Allowlist entries are regular expressions matched against the whole metric
+// name
+func compileCommandAllowlist(patterns []string) error {
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+
+		if err != nil {
+			return fmt.Errorf("invalid command allowlist entry %q: %v",
+				pattern, err)
+		}
+
+		commandAllowlist = append(commandAllowlist, re)
+	}
+
+	return nil
+}
+
+func isWritableMetric(name string) bool {
+	for _, re := range commandAllowlist {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getDatatypeName(datatype uint32) string {
+	for name, value := range sparkplugDatatypes {
+		if value == datatype {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("%d", datatype)
+}
+
+// Decode a JSON value into the protobuf value of a metric.  Integers are
+// range checked, the signed ones are sent as two's complement as the spec
+// expects.
+func setCommandValue(metric *pb.Payload_Metric, datatype uint32,
+	value json.RawMessage) error {
+
+	var errOutOfRange = errors.New("value out of range for the datatype")
+
+	switch datatype {
+	case PBInt8, PBInt16, PBInt32, PBInt64:
+		var number int64
+
+		if err := json.Unmarshal(value, &number); err != nil {
+			return err
+		}
+
+		bits := map[uint32]uint{PBInt8: 8, PBInt16: 16, PBInt32: 32,
+			PBInt64: 64}[datatype]
+
+		if bits < 64 && (number < -(1<<(bits-1)) || number >= 1<<(bits-1)) {
+			return errOutOfRange
+		}
+
+		if datatype == PBInt64 {
+			metric.Value = &pb.Payload_Metric_LongValue{
+				LongValue: uint64(number),
+			}
+		} else {
+			metric.Value = &pb.Payload_Metric_IntValue{
+				IntValue: uint32(number),
+			}
+		}
+	case PBUInt8, PBUInt16, PBUInt32, PBUInt64, PBDateTime:
+		var number uint64
+
+		if err := json.Unmarshal(value, &number); err != nil {
+			return err
+		}
+
+		bits := map[uint32]uint{PBUInt8: 8, PBUInt16: 16, PBUInt32: 32,
+			PBUInt64: 64, PBDateTime: 64}[datatype]
+
+		if bits < 64 && number >= 1<<bits {
+			return errOutOfRange
+		}
+
+		if bits == 64 {
+			metric.Value = &pb.Payload_Metric_LongValue{LongValue: number}
+		} else {
+			metric.Value = &pb.Payload_Metric_IntValue{
+				IntValue: uint32(number),
+			}
+		}
+	case PBFloat:
+		var number float64
+
+		if err := json.Unmarshal(value, &number); err != nil {
+			return err
+		}
+
+		if math.Abs(number) > math.MaxFloat32 {
+			return errOutOfRange
+		}
+
+		metric.Value = &pb.Payload_Metric_FloatValue{
+			FloatValue: float32(number),
+		}
+	case PBDouble:
+		var number float64
+
+		if err := json.Unmarshal(value, &number); err != nil {
+			return err
+		}
+
+		metric.Value = &pb.Payload_Metric_DoubleValue{DoubleValue: number}
+	case PBBoolean:
+		var flag bool
+
+		if err := json.Unmarshal(value, &flag); err != nil {
+			return err
+		}
+
+		metric.Value = &pb.Payload_Metric_BooleanValue{BooleanValue: flag}
+	case PBString, PBText, PBUUID:
+		var text string
+
+		if err := json.Unmarshal(value, &text); err != nil {
+			return err
+		}
+
+		metric.Value = &pb.Payload_Metric_StringValue{StringValue: text}
+	default:
+		return errors.New("datatype can not be written")
+	}
+
+	metric.Datatype = &datatype
+	return nil
+}
+
+// Every command request goes to the log along with its outcome, and as a
+// JSON line to the audit file when one is configured
+func auditCommand(audit commandAudit) {
+	log.Infof("Command %s/%s/%s %s=%s (%s) from %s: %s\n", audit.Group,
+		audit.Node, audit.Device, audit.Metric, string(audit.Value),
+		audit.Datatype, audit.Remote, audit.Outcome)
+
+	if *commandAuditFile == "" {
+		return
+	}
+
+	line, _ := json.Marshal(audit)
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	file, err := os.OpenFile(*commandAuditFile,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+
+	if err != nil {
+		log.Errorf("Error opening audit file %s: %v\n", *commandAuditFile, err)
+		return
+	}
+
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Errorf("Error writing audit file %s: %v\n", *commandAuditFile, err)
+	}
+}
+
+// POST /api/v1/command with a JSON body:
+//
+//	{"group": "Site1", "node": "Gateway", "device": "Inverter1",
+//	 "metric": "Setpoints/Power", "datatype": "Float", "value": 250.5}
+//
+// Without a device the metric is written to the edge node with an NCMD.
+// Every request is audited, rejected ones included.
+func commandAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var request commandRequest
+	var code int
+
+	audit := commandAudit{Time: time.Now(), Remote: r.RemoteAddr}
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+
+	if err != nil {
+		code = http.StatusBadRequest
+		err = fmt.Errorf("invalid request body: %v", err)
+	} else {
+		audit.Group = request.Group
+		audit.Node = request.Node
+		audit.Device = request.Device
+		audit.Metric = request.Metric
+		audit.Datatype = request.Datatype
+		audit.Value = request.Value
+
+		audit.Topic, code, err = processCommand(&request)
+	}
+
+	audit.Sent = err == nil
+	audit.Outcome = "sent"
+
+	if err != nil {
+		audit.Outcome = err.Error()
+	}
+
+	auditCommand(audit)
+
+	if err != nil {
+		writeAPIError(w, code, err.Error())
+		return
+	}
+
+	writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success"})
+}
+
+// Validate a command request and publish it, returns the topic (once known)
+// and on failure the HTTP status to answer with
+func processCommand(request *commandRequest) (string, int, error) {
+	if request.Group == "" || request.Node == "" || request.Metric == "" ||
+		request.Datatype == "" || len(request.Value) == 0 {
+		return "", http.StatusBadRequest,
+			errors.New("group, node, metric, datatype and value are required")
+	}
+
+	if !isWritableMetric(request.Metric) {
+		return "", http.StatusForbidden, errors.New("metric is not writable")
+	}
+
+	datatype, known := sparkplugDatatypes[request.Datatype]
+
+	if !known {
+		return "", http.StatusBadRequest, errors.New("unknown datatype")
+	}
+
+	mutex.RLock()
+
+	node, exists := edgeNodeList[edgeNodeKey(request.Group, request.Node)]
+
+	var birth *pb.Payload_Metric
+	namespace := request.Namespace
+
+	if exists && (namespace == "" || namespace == node.namespace) {
+		birth = node.getBirthMetric(request.Device, request.Metric)
+		namespace = node.namespace
+	}
+
+	mutex.RUnlock()
+
+	if birth == nil {
+		return "", http.StatusNotFound,
+			errors.New("metric not declared in the last birth certificate")
+	}
+
+	if birth.GetDatatype() != datatype {
+		return "", http.StatusBadRequest, fmt.Errorf("metric was born as %s",
+			getDatatypeName(birth.GetDatatype()))
+	}
+
+	metricName := request.Metric
+	timestamp := uint64(time.Now().UnixNano() / 1000000)
+	metric := pb.Payload_Metric{Name: &metricName, Timestamp: &timestamp}
+
+	if err := setCommandValue(&metric, datatype, request.Value); err != nil {
+		return "", http.StatusBadRequest, fmt.Errorf("invalid value: %v", err)
+	}
+
+	pbMsg := pb.Payload{
+		Timestamp: &timestamp,
+		Metrics:   []*pb.Payload_Metric{&metric},
+	}
+
+	topic := newNodeTopic(namespace, request.Group, msgNCMD,
+		request.Node).String()
+
+	if request.Device != "" {
+		topic = newDeviceTopic(namespace, request.Group, msgDCMD,
+			request.Node, request.Device).String()
+	}
+
+	if _, err := parseTopic(topic); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	if !exporter.sendCommand(namespace, request.Group, request.Node, &pbMsg,
+		topic) {
+		return topic, http.StatusBadGateway,
+			errors.New("command not published")
+	}
+
+	return topic, http.StatusOK, nil
+}
+
+// Publish a command on behalf of the API, counted per edge node
+func (e *spplugExporter) sendCommand(namespace string, group string,
+	nodeID string, pbMsg *pb.Payload, topic string) bool {
+
+	_, labelValues := getNodeLabelSetandValues(namespace, group, nodeID)
+
+	if e.client.IsConnectionOpen() && sendMQTTMsg(e.client, pbMsg, topic) {
+		e.counterMetrics[SPCommandSent].With(labelValues).Inc()
+		return true
+	}
+
+	e.counterMetrics[SPCommandFailures].With(labelValues).Inc()
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"testing"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestSetCommandValue(t *testing.T) {
+	tests := []struct {
+		datatype uint32
+		value    string
+		want     interface{}
+	}{
+		{PBInt8, "127", &pb.Payload_Metric_IntValue{IntValue: 127}},
+		{PBInt8, "-128", &pb.Payload_Metric_IntValue{IntValue: 0xFFFFFF80}},
+		{PBInt8, "128", nil},
+		{PBInt8, "-129", nil},
+		{PBInt16, "-1", &pb.Payload_Metric_IntValue{IntValue: 0xFFFFFFFF}},
+		{PBInt32, "2147483648", nil},
+		{PBInt32, "1.5", nil},
+		{PBInt64, "-1", &pb.Payload_Metric_LongValue{
+			LongValue: 0xFFFFFFFFFFFFFFFF}},
+		{PBUInt8, "255", &pb.Payload_Metric_IntValue{IntValue: 255}},
+		{PBUInt8, "256", nil},
+		{PBUInt8, "-1", nil},
+		{PBUInt64, "18446744073709551615", &pb.Payload_Metric_LongValue{
+			LongValue: 0xFFFFFFFFFFFFFFFF}},
+		{PBFloat, "250.5", &pb.Payload_Metric_FloatValue{FloatValue: 250.5}},
+		{PBFloat, "1e39", nil},
+		{PBDouble, "1e39", &pb.Payload_Metric_DoubleValue{
+			DoubleValue: 1e39}},
+		{PBBoolean, "true", &pb.Payload_Metric_BooleanValue{
+			BooleanValue: true}},
+		{PBBoolean, "1", nil},
+		{PBString, `"on"`, &pb.Payload_Metric_StringValue{
+			StringValue: "on"}},
+		{PBString, "1", nil},
+		{PBDataSet, "{}", nil},
+	}
+
+	for _, test := range tests {
+		var metric pb.Payload_Metric
+
+		err := setCommandValue(&metric, test.datatype,
+			json.RawMessage(test.value))
+
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s %s: expected an error, got %v",
+					getDatatypeName(test.datatype), test.value, metric.Value)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s %s: %v", getDatatypeName(test.datatype), test.value,
+				err)
+			continue
+		}
+
+		if !reflect.DeepEqual(metric.Value, test.want) {
+			t.Errorf("%s %s: got %v, want %v",
+				getDatatypeName(test.datatype), test.value, metric.Value,
+				test.want)
+		}
+
+		if metric.GetDatatype() != test.datatype {
+			t.Errorf("%s %s: datatype %d", getDatatypeName(test.datatype),
+				test.value, metric.GetDatatype())
+		}
+	}
+}
+
+// A broker connection that is never open, commands that pass validation fail
+// to be published
+type disconnectedClient struct {
+	mqtt.Client
+}
+
+func (c disconnectedClient) IsConnectionOpen() bool {
+	return false
+}
+
+func TestProcessCommand(t *testing.T) {
+	defer func(allowlist []*regexp.Regexp, e *spplugExporter) {
+		commandAllowlist = allowlist
+		exporter = e
+	}(commandAllowlist, exporter)
+
+	commandAllowlist = nil
+
+	if err := compileCommandAllowlist([]string{"Setpoints/.*"}); err != nil {
+		t.Fatal(err)
+	}
+
+	exporter = newTestExporter()
+	exporter.client = disconnectedClient{}
+
+	node := newEdgeNode("spBv1.0", "G1", "N1")
+	node.storeBirth("D1", []*pb.Payload_Metric{
+		{Name: proto.String("Setpoints/Power"),
+			Datatype: proto.Uint32(PBFloat)},
+		{Name: proto.String("Setpoints/Mode"),
+			Datatype: proto.Uint32(PBInt8)},
+		{Name: proto.String("Status"), Datatype: proto.Uint32(PBInt8)},
+	})
+	edgeNodeList[edgeNodeKey("G1", "N1")] = node
+
+	tests := []struct {
+		name     string
+		request  commandRequest
+		wantCode int
+	}{
+		{"missing value", commandRequest{Group: "G1", Node: "N1",
+			Device: "D1", Metric: "Setpoints/Power", Datatype: "Float"},
+			http.StatusBadRequest},
+		{"not on the allowlist", commandRequest{Group: "G1", Node: "N1",
+			Device: "D1", Metric: "Status", Datatype: "Int8",
+			Value: json.RawMessage("1")}, http.StatusForbidden},
+		{"unknown datatype", commandRequest{Group: "G1", Node: "N1",
+			Device: "D1", Metric: "Setpoints/Power", Datatype: "Real",
+			Value: json.RawMessage("1")}, http.StatusBadRequest},
+		{"unknown metric", commandRequest{Group: "G1", Node: "N1",
+			Device: "D1", Metric: "Setpoints/Speed", Datatype: "Float",
+			Value: json.RawMessage("1")}, http.StatusNotFound},
+		{"unknown device", commandRequest{Group: "G1", Node: "N1",
+			Device: "D2", Metric: "Setpoints/Power", Datatype: "Float",
+			Value: json.RawMessage("1")}, http.StatusNotFound},
+		{"other namespace", commandRequest{Namespace: "spAv1.0",
+			Group: "G1", Node: "N1", Device: "D1",
+			Metric: "Setpoints/Power", Datatype: "Float",
+			Value: json.RawMessage("1")}, http.StatusNotFound},
+		{"wrong datatype", commandRequest{Group: "G1", Node: "N1",
+			Device: "D1", Metric: "Setpoints/Power", Datatype: "Double",
+			Value: json.RawMessage("1")}, http.StatusBadRequest},
+		{"out of range", commandRequest{Group: "G1", Node: "N1",
+			Device: "D1", Metric: "Setpoints/Mode", Datatype: "Int8",
+			Value: json.RawMessage("200")}, http.StatusBadRequest},
+		{"not connected", commandRequest{Group: "G1", Node: "N1",
+			Device: "D1", Metric: "Setpoints/Mode", Datatype: "Int8",
+			Value: json.RawMessage("-2")}, http.StatusBadGateway},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			topic, code, err := processCommand(&test.request)
+
+			if code != test.wantCode {
+				t.Errorf("code %d (%v), want %d", code, err, test.wantCode)
+			}
+
+			if err == nil {
+				t.Error("expected an error")
+			}
+
+			if code == http.StatusBadGateway &&
+				topic != "spBv1.0/G1/DCMD/N1/D1" {
+				t.Errorf("topic %s", topic)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Configuration file given with --config.file.  It holds the relabeling rules
+// applied to every metric before its series are created, working the same way
+// as the relabel_configs of Prometheus:
+//
+//   relabel_configs:
+//     - source_labels: [__name__]
+//       regex: debug_.*
+//       action: drop
+//
+// The metric name is available as __name__, the labels are those from the
+// topic and the metric path.
+
+const (
+	SPMetricNameLabel string = "__name__"
+)
+
+type config struct {
+	RelabelConfigs []*relabelConfig `yaml:"relabel_configs"`
+}
+
+type relabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+
+	regex *regexp.Regexp
+}
+
+var relabelConfigs []*relabelConfig
+
+// Fill in the Prometheus defaults for whatever the rule leaves out
+func (c *relabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain relabelConfig
+
+	*c = relabelConfig{
+		Separator:   ";",
+		Regex:       "(.*)",
+		Replacement: "$1",
+		Action:      "replace",
+	}
+
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %v", c.Regex, err)
+	}
+
+	c.regex = regex
+
+	switch c.Action {
+	case "replace":
+		if c.TargetLabel == "" {
+			return fmt.Errorf("replace requires a target_label")
+		}
+	case "keep", "drop":
+		if len(c.SourceLabels) == 0 {
+			return fmt.Errorf("%s requires source_labels", c.Action)
+		}
+	case "labelmap", "labeldrop":
+	default:
+		return fmt.Errorf("unknown relabel action %q", c.Action)
+	}
+
+	return nil
+}
+
+func loadConfig(filename string) error {
+	var cfg config
+
+	content, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return fmt.Errorf("parsing %s: %v", filename, err)
+	}
+
+	relabelConfigs = cfg.RelabelConfigs
+	return nil
+}
+
+// Apply a single rule, returns false if the metric has to be dropped
+func (c *relabelConfig) apply(labelValues prometheus.Labels) bool {
+	values := make([]string, 0, len(c.SourceLabels))
+
+	for _, label := range c.SourceLabels {
+		values = append(values, labelValues[label])
+	}
+
+	value := strings.Join(values, c.Separator)
+
+	switch c.Action {
+	case "keep":
+		return c.regex.MatchString(value)
+	case "drop":
+		return !c.regex.MatchString(value)
+	case "replace":
+		indexes := c.regex.FindStringSubmatchIndex(value)
+
+		if indexes == nil {
+			return true
+		}
+
+		target := string(c.regex.ExpandString(nil, c.TargetLabel, value,
+			indexes))
+		replacement := string(c.regex.ExpandString(nil, c.Replacement,
+			value, indexes))
+
+		if !model.LabelName(target).IsValid() {
+			return true
+		}
+
+		if replacement == "" {
+			delete(labelValues, target)
+		} else {
+			labelValues[target] = replacement
+		}
+	case "labelmap":
+		// Only the labels from before the rule are mapped, in order so that
+		// the result does not depend on the map iteration
+		labels := make([]string, 0, len(labelValues))
+
+		for label := range labelValues {
+			labels = append(labels, label)
+		}
+
+		sort.Strings(labels)
+		mapped := make(prometheus.Labels)
+
+		for _, label := range labels {
+			if !c.regex.MatchString(label) {
+				continue
+			}
+
+			target := c.regex.ReplaceAllString(label, c.Replacement)
+
+			if model.LabelName(target).IsValid() {
+				mapped[target] = labelValues[label]
+			}
+		}
+
+		for label, labelValue := range mapped {
+			labelValues[label] = labelValue
+		}
+	case "labeldrop":
+		for label := range labelValues {
+			if c.regex.MatchString(label) {
+				delete(labelValues, label)
+			}
+		}
+	}
+
+	return true
+}
+
+// Run the metric name and labels through the relabeling rules.  Returns the
+// new name and labels, labels keep their order with new ones added at the end,
+// or false if the metric was dropped.
+func relabelMetric(metricName string, metricLabels []string,
+	metricLabelValues prometheus.Labels) (string, []string,
+	prometheus.Labels, bool) {
+
+	if len(relabelConfigs) == 0 {
+		return metricName, metricLabels, metricLabelValues, true
+	}
+
+	labelValues := cloneLabelSet(metricLabelValues)
+	labelValues[SPMetricNameLabel] = metricName
+
+	for _, rule := range relabelConfigs {
+		if !rule.apply(labelValues) {
+			return "", nil, nil, false
+		}
+	}
+
+	metricName = labelValues[SPMetricNameLabel]
+
+	// Labels starting with __ are only available during relabeling
+	for label := range labelValues {
+		if strings.HasPrefix(label, "__") {
+			delete(labelValues, label)
+		}
+	}
+
+	var labels, added []string
+
+	for _, label := range metricLabels {
+		if _, exists := labelValues[label]; exists {
+			labels = append(labels, label)
+		}
+	}
+
+	for label := range labelValues {
+		if !containsLabel(labels, label) {
+			added = append(added, label)
+		}
+	}
+
+	sort.Strings(added)
+
+	return metricName, append(labels, added...), labelValues, true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+func setRelabelConfigs(t *testing.T, content string) {
+	var cfg config
+
+	if err := yaml.UnmarshalStrict([]byte(content), &cfg); err != nil {
+		t.Fatalf("parsing config: %v", err)
+	}
+
+	relabelConfigs = cfg.RelabelConfigs
+	t.Cleanup(func() { relabelConfigs = nil })
+}
+
+func TestRelabelMetric(t *testing.T) {
+	setRelabelConfigs(t, `
+relabel_configs:
+  - source_labels: [__name__]
+    regex: debug_.*
+    action: drop
+  - source_labels: [__name__]
+    regex: (.*)_degC
+    target_label: __name__
+    replacement: ${1}_celsius
+  - source_labels: [sp_group_id, sp_edge_node_id]
+    separator: /
+    target_label: node
+  - regex: sp_(namespace|edge_node_id)
+    action: labeldrop
+  - regex: tag_(.*)
+    action: labelmap
+  - source_labels: [unit]
+    target_label: unit
+    replacement: ""
+`)
+
+	labels := []string{SPNamespace, SPGroupID, SPEdgeNodeID, "tag_room",
+		"unit"}
+	labelValues := prometheus.Labels{
+		SPNamespace:  "spBv1.0",
+		SPGroupID:    "G1",
+		SPEdgeNodeID: "N1",
+		"tag_room":   "A",
+		"unit":       "C",
+	}
+
+	name, gotLabels, gotValues, keep := relabelMetric("temp_degC", labels,
+		labelValues)
+
+	if !keep {
+		t.Fatal("metric was dropped")
+	}
+
+	if name != "temp_celsius" {
+		t.Errorf("name %s, want temp_celsius", name)
+	}
+
+	wantLabels := []string{SPGroupID, "tag_room", "node", "room"}
+	wantValues := prometheus.Labels{
+		SPGroupID:  "G1",
+		"tag_room": "A",
+		"node":     "G1/N1",
+		"room":     "A",
+	}
+
+	if !reflect.DeepEqual(gotLabels, wantLabels) {
+		t.Errorf("labels %v, want %v", gotLabels, wantLabels)
+	}
+
+	if !reflect.DeepEqual(gotValues, wantValues) {
+		t.Errorf("values %v, want %v", gotValues, wantValues)
+	}
+
+	if len(labelValues) != 5 {
+		t.Errorf("input labels modified: %v", labelValues)
+	}
+
+	if _, _, _, keep := relabelMetric("debug_counter", labels,
+		labelValues); keep {
+		t.Error("debug_counter should have been dropped")
+	}
+}
+
+func TestRelabelMetricKeep(t *testing.T) {
+	setRelabelConfigs(t, `
+relabel_configs:
+  - source_labels: [sp_group_id]
+    regex: Site1|Site2
+    action: keep
+`)
+
+	for group, want := range map[string]bool{"Site1": true, "Site3": false} {
+		_, _, _, keep := relabelMetric("temp", []string{SPGroupID},
+			prometheus.Labels{SPGroupID: group})
+
+		if keep != want {
+			t.Errorf("%s: keep %t, want %t", group, keep, want)
+		}
+	}
+}
+
+func TestRelabelConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		"relabel_configs: [{action: replace}]",
+		"relabel_configs: [{action: keep}]",
+		"relabel_configs: [{action: hashmod, source_labels: [a]}]",
+		"relabel_configs: [{regex: '(', action: labeldrop}]",
+		"relabel_configs: [{unknown_field: 1}]",
+	} {
+		var cfg config
+
+		if err := yaml.UnmarshalStrict([]byte(content), &cfg); err == nil {
+			t.Errorf("%s: expected an error", content)
+		}
+	}
+}
+
+func TestRelabelMetricLabelmap(t *testing.T) {
+	setRelabelConfigs(t, `
+relabel_configs:
+  - regex: (.*)
+    replacement: x_$1
+    action: labelmap
+  - regex: tag_(.*)
+    replacement: 1$1
+    action: labelmap
+`)
+
+	labels := []string{SPGroupID, "tag_room"}
+	labelValues := prometheus.Labels{SPGroupID: "G1", "tag_room": "A"}
+
+	// Mapped labels are not mapped again within the same rule
+	wantLabels := []string{SPGroupID, "tag_room", "x___name__",
+		"x_sp_group_id", "x_tag_room"}
+	wantValues := prometheus.Labels{
+		SPGroupID:       "G1",
+		"tag_room":      "A",
+		"x___name__":    "temp",
+		"x_sp_group_id": "G1",
+		"x_tag_room":    "A",
+	}
+
+	for i := 0; i < 10; i++ {
+		_, gotLabels, gotValues, _ := relabelMetric("temp", labels,
+			labelValues)
+
+		if !reflect.DeepEqual(gotLabels, wantLabels) {
+			t.Fatalf("labels %v, want %v", gotLabels, wantLabels)
+		}
+
+		if !reflect.DeepEqual(gotValues, wantValues) {
+			t.Fatalf("values %v, want %v", gotValues, wantValues)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strconv"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// A DataSet is a table, each numeric column becomes its own metric named
+// <metric>_<column> with one series per row.  Rows are told apart by the
+// sp_row label, holding either the row index or the value of the configured
+// key column.  String columns are dropped or added as labels to the row.
+
+// String representation of a cell, used when it ends up in a label
+func formatDataSetValue(value *pb.Payload_DataSet_DataSetValue,
+	datatype uint32) string {
+
+	if isStringDatatype(datatype) {
+		return truncateString(value.GetStringValue(), *stringMaxLength)
+	}
+
+	if metricVal, err := convertValueToFloat(value,
+		datatype); err == nil {
+		return strconv.FormatFloat(metricVal, 'f', -1, 64)
+	}
+
+	return ""
+}
+
+func (e *spplugExporter) exportDataSet(source *metricSource,
+	dataset *pb.Payload_DataSet, metricName string, metricLabels []string,
+	metricLabelValues prometheus.Labels) {
+
+	columns := dataset.GetColumns()
+	types := dataset.GetTypes()
+
+	if len(types) != len(columns) {
+		log.Warnf("DataSet %s has %d columns but %d types\n", metricName,
+			len(columns), len(types))
+		return
+	}
+
+	keyColumn := -1
+	var stringColumns []int
+
+	for index, column := range columns {
+		if column == *datasetKeyColumn {
+			keyColumn = index
+		} else if isStringDatatype(types[index]) &&
+			*datasetStringColumns == "label" {
+			stringColumns = append(stringColumns, index)
+		}
+	}
+
+	rowLabels := append(metricLabels, SPDataSetRow)
+	var labelColumns []int
+
+	// A column must not replace one of the topic or folder labels, or
+	// another column
+	for _, index := range stringColumns {
+		label := sanitizeLabelName(columns[index])
+
+		if _, exists := metricLabelValues[label]; exists ||
+			containsLabel(rowLabels, label) {
+			log.Debugf("Ignoring column %s of DataSet %s, label already set\n",
+				columns[index], metricName)
+			continue
+		}
+
+		rowLabels = append(rowLabels, label)
+		labelColumns = append(labelColumns, index)
+	}
+
+	for rowIndex, row := range dataset.GetRows() {
+		elements := row.GetElements()
+
+		if len(elements) != len(columns) {
+			log.Warnf("DataSet %s row %d has %d elements for %d columns\n",
+				metricName, rowIndex, len(elements), len(columns))
+			continue
+		}
+
+		rowLabelValues := cloneLabelSet(metricLabelValues)
+		rowLabelValues[SPDataSetRow] = strconv.Itoa(rowIndex)
+
+		if keyColumn >= 0 {
+			rowLabelValues[SPDataSetRow] = formatDataSetValue(
+				elements[keyColumn], types[keyColumn])
+		}
+
+		for _, index := range labelColumns {
+			rowLabelValues[sanitizeLabelName(columns[index])] =
+				formatDataSetValue(elements[index], types[index])
+		}
+
+		for index, column := range columns {
+			if index == keyColumn {
+				continue
+			}
+
+			metricVal, err := convertValueToFloat(elements[index],
+				types[index])
+
+			if err != nil {
+				continue
+			}
+
+			columnName := metricName + "_" + sanitizeLabelName(column)
+
+			if types[index] == PBDateTime {
+				columnName = getTimestampMetricName(columnName)
+			}
+
+			e.exportSeries(source, columnName, rowLabels, rowLabelValues,
+				metricVal)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	"github.com/golang/protobuf/proto"
+)
+
+func newDataSetRow(name string, device string,
+	value float32) *pb.Payload_DataSet_Row {
+
+	stringValue := func(value string) *pb.Payload_DataSet_DataSetValue {
+		return &pb.Payload_DataSet_DataSetValue{
+			Value: &pb.Payload_DataSet_DataSetValue_StringValue{
+				StringValue: value,
+			},
+		}
+	}
+
+	return &pb.Payload_DataSet_Row{
+		Elements: []*pb.Payload_DataSet_DataSetValue{
+			stringValue(name),
+			stringValue(device),
+			stringValue(name + " copy"),
+			{Value: &pb.Payload_DataSet_DataSetValue_FloatValue{
+				FloatValue: value,
+			}},
+		},
+	}
+}
+
+func TestDataSetStringColumns(t *testing.T) {
+	defer func(mode string) { *datasetStringColumns = mode }(
+		*datasetStringColumns)
+	*datasetStringColumns = "label"
+
+	e := newTestExporter()
+	source := newTestSource(t, "spBv1.0/G1/DDATA/N1/D1")
+
+	metric := &pb.Payload_Metric{
+		Name:     proto.String("Strings"),
+		Datatype: proto.Uint32(PBDataSet),
+		Value: &pb.Payload_Metric_DatasetValue{
+			DatasetValue: &pb.Payload_DataSet{
+				Columns: []string{"Name", "sp_device_id", "Name",
+					"Voltage"},
+				Types: []uint32{PBString, PBString, PBString, PBFloat},
+				Rows: []*pb.Payload_DataSet_Row{
+					newDataSetRow("S1", "X", 3.5),
+					newDataSetRow("S2", "Y", 3.25),
+				},
+			},
+		},
+	}
+
+	e.processMetric(source, metric)
+
+	// Neither the topic label nor the first column are replaced
+	want := []string{
+		`Strings_Voltage{Name="S1",sp_row="0"} 3.5`,
+		`Strings_Voltage{Name="S2",sp_row="1"} 3.25`,
+	}
+
+	if got := gatherSeries(t, e); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, sample := range e.metrics["Strings_Voltage"].series {
+		if sample.labelValues[SPDeviceID] != "D1" {
+			t.Errorf("sp_device_id %s, want D1",
+				sample.labelValues[SPDeviceID])
+		}
+	}
+}
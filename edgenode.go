@@ -0,0 +1,307 @@
+package main
+
+import (
+	"strings"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// edgeNode holds what we know about a Sparkplug edge node (and the devices
+// attached to it) from the birth certificates it has published
+type edgeNode struct {
+	namespace string
+	group     string
+	nodeID    string
+
+	// Aliases and metrics declared in the NBIRTH, devices keep their own
+	// from DBIRTH
+	aliases map[uint64]string
+	birth   map[string]*pb.Payload_Metric
+	devices map[string]*edgeDevice
+
+	// Template definitions from the NBIRTH, by name
+	templates map[string]*pb.Payload_Template
+
+	// Series created from the node's own metrics
+	series map[seriesKey]seriesRef
+
+	// Between NBIRTH and NDEATH
+	online bool
+
+	// Last sequence number received, only valid once seqValid is set
+	seq      uint64
+	seqValid bool
+
+	// Birth/death sequence of the current session, from the NBIRTH
+	bdSeq      uint64
+	bdSeqValid bool
+}
+
+type edgeDevice struct {
+	aliases map[uint64]string
+	birth   map[string]*pb.Payload_Metric
+	series  map[seriesKey]seriesRef
+	online  bool
+}
+
+// A single time series in spplugExporter.metrics, tracked so that it can be
+// removed once its edge node or device dies
+type seriesKey struct {
+	metricName string
+	signature  uint64
+}
+
+type seriesRef struct {
+	metricName  string
+	labelValues prometheus.Labels
+}
+
+// Outcome of checking the sequence number of a message
+type seqResult int
+
+const (
+	seqOK seqResult = iota
+	seqGap
+	seqDuplicate
+	seqOutOfOrder
+)
+
+func edgeNodeKey(group string, nodeID string) string {
+	return group + "/" + nodeID
+}
+
+func newEdgeNode(namespace string, group string, nodeID string) *edgeNode {
+	return &edgeNode{
+		namespace: namespace,
+		group:     group,
+		nodeID:    nodeID,
+		aliases:   make(map[uint64]string),
+		birth:     make(map[string]*pb.Payload_Metric),
+		devices:   make(map[string]*edgeDevice),
+		templates: make(map[string]*pb.Payload_Template),
+		series:    make(map[seriesKey]seriesRef),
+	}
+}
+
+func (n *edgeNode) getDevice(deviceID string) *edgeDevice {
+	device, exists := n.devices[deviceID]
+
+	if !exists {
+		device = &edgeDevice{
+			aliases: make(map[uint64]string),
+			birth:   make(map[string]*pb.Payload_Metric),
+			series:  make(map[seriesKey]seriesRef),
+		}
+		n.devices[deviceID] = device
+	}
+
+	return device
+}
+
+func (n *edgeNode) getNodeLabelValues() prometheus.Labels {
+	_, labelValues := getNodeLabelSetandValues(n.namespace, n.group, n.nodeID)
+	return labelValues
+}
+
+func (n *edgeNode) getDeviceLabelValues(deviceID string) prometheus.Labels {
+	labelValues := n.getNodeLabelValues()
+	labelValues[SPDeviceID] = deviceID
+	return labelValues
+}
+
+// Remember a series published by the node (empty deviceID) or one of its
+// devices
+func (n *edgeNode) trackSeries(deviceID string, metricName string,
+	labelValues prometheus.Labels) {
+
+	series := n.series
+
+	if deviceID != "" {
+		series = n.getDevice(deviceID).series
+	}
+
+	key := seriesKey{
+		metricName: metricName,
+		signature:  model.LabelsToSignature(labelValues),
+	}
+
+	series[key] = seriesRef{
+		metricName:  metricName,
+		labelValues: labelValues,
+	}
+}
+
+// Every message from an edge node (and its devices) other than NDEATH
+// carries a sequence number that wraps from 255 back to 0, starting over with
+// the NBIRTH.  Anything other than the next number means we lost, repeated
+// or reordered a message.  Messages more than half the range behind are
+// treated as a gap since we cannot tell the two apart.
+func (n *edgeNode) checkSequence(msgType messageType, seq uint64) seqResult {
+	// A birth starts a new sequence, and if we joined in the middle of a
+	// session all we can do is start from here
+	if msgType == msgNBIRTH || !n.seqValid {
+		n.seq = seq
+		n.seqValid = true
+		return seqOK
+	}
+
+	behind := (n.seq + SPSequenceRange - seq) % SPSequenceRange
+
+	switch {
+	case seq == (n.seq+1)%SPSequenceRange:
+		n.seq = seq
+		return seqOK
+	case behind == 0:
+		return seqDuplicate
+	case behind < SPSequenceRange/2:
+		return seqOutOfOrder
+	default:
+		n.seq = seq
+		return seqGap
+	}
+}
+
+// Remember the bdSeq of the session started by an NBIRTH
+func (n *edgeNode) storeBdSeq(metrics []*pb.Payload_Metric) {
+	n.bdSeq, n.bdSeqValid = getBdSeq(metrics)
+}
+
+// An NDEATH belongs to the current session when its bdSeq matches the one
+// from the NBIRTH.  A Last Will registered by an earlier connection can be
+// delivered after the edge node has already reconnected and published a new
+// birth, that death must not take the node offline.
+func (n *edgeNode) isCurrentDeath(metrics []*pb.Payload_Metric) bool {
+	bdSeq, found := getBdSeq(metrics)
+
+	if !found || !n.bdSeqValid {
+		return true
+	}
+
+	return bdSeq == n.bdSeq
+}
+
+func (n *edgeNode) untrackSeries(deviceID string, metricName string,
+	labelValues prometheus.Labels) {
+
+	series := n.series
+
+	if deviceID != "" {
+		series = n.getDevice(deviceID).series
+	}
+
+	delete(series, seriesKey{
+		metricName: metricName,
+		signature:  model.LabelsToSignature(labelValues),
+	})
+}
+
+// A birth certificate carries the full name for every metric along with the
+// alias that subsequent data messages will use, its data type and
+// properties.  Each birth replaces the previous tables since aliases are only
+// valid for a single session.
+func (n *edgeNode) storeBirth(deviceID string,
+	metrics []*pb.Payload_Metric) {
+	aliases := make(map[uint64]string)
+	birth := make(map[string]*pb.Payload_Metric)
+
+	for _, metric := range metrics {
+		if metric.Alias != nil && metric.GetName() != "" {
+			aliases[metric.GetAlias()] = metric.GetName()
+		}
+
+		if metric.GetName() != "" {
+			birth[metric.GetName()] = metric
+		}
+	}
+
+	if deviceID == "" {
+		n.aliases = aliases
+		n.birth = birth
+	} else {
+		device := n.getDevice(deviceID)
+		device.aliases = aliases
+		device.birth = birth
+	}
+}
+
+// The metric as declared in the last birth certificate, nil if unknown
+func (n *edgeNode) getBirthMetric(deviceID string,
+	name string) *pb.Payload_Metric {
+
+	if deviceID == "" {
+		return n.birth[name]
+	}
+
+	if device, exists := n.devices[deviceID]; exists {
+		return device.birth[name]
+	}
+
+	return nil
+}
+
+// Data messages only need to carry the value of a metric, whatever they leave
+// out (data type, properties other than the quality) is taken from the birth
+// certificate
+func (n *edgeNode) completeMetric(deviceID string, metric *pb.Payload_Metric) {
+	birth := n.getBirthMetric(deviceID, metric.GetName())
+
+	if birth == nil || birth == metric {
+		return
+	}
+
+	if metric.Datatype == nil {
+		metric.Datatype = birth.Datatype
+	}
+
+	metric.Properties = inheritProperties(metric.GetProperties(),
+		birth.GetProperties())
+}
+
+// Template definitions are only published in the NBIRTH, instances (from the
+// node or its devices) refer to them by name through template_ref
+func (n *edgeNode) storeTemplates(metrics []*pb.Payload_Metric) {
+	templates := make(map[string]*pb.Payload_Template)
+
+	for _, metric := range metrics {
+		template := metric.GetTemplateValue()
+
+		if template != nil && template.GetIsDefinition() {
+			templates[strings.TrimPrefix(metric.GetName(),
+				SPTemplateTypesFolder)] = template
+		}
+	}
+
+	n.templates = templates
+}
+
+// Fill in the name of an aliased metric.  Device aliases are looked up first
+// and then the node, as the spec makes aliases unique across the edge node.
+// Returns false when the metric only has an alias we have never been told
+// about.
+func (n *edgeNode) resolveAlias(deviceID string,
+	metric *pb.Payload_Metric) bool {
+
+	if metric.GetName() != "" || metric.Alias == nil {
+		return true
+	}
+
+	alias := metric.GetAlias()
+
+	if deviceID != "" {
+		if device, exists := n.devices[deviceID]; exists {
+			if name, found := device.aliases[alias]; found {
+				metric.Name = &name
+				return true
+			}
+		}
+	}
+
+	if name, found := n.aliases[alias]; found {
+		metric.Name = &name
+		return true
+	}
+
+	return false
+}
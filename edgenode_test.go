@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestCheckSequence(t *testing.T) {
+	tests := []struct {
+		name     string
+		last     uint64
+		msgType  messageType
+		seq      uint64
+		want     seqResult
+		wantLast uint64
+	}{
+		{"next", 10, msgNDATA, 11, seqOK, 11},
+		{"wraps around", 255, msgDDATA, 0, seqOK, 0},
+		{"duplicate", 10, msgNDATA, 10, seqDuplicate, 10},
+		{"out of order", 10, msgNDATA, 8, seqOutOfOrder, 10},
+		{"out of order across the wrap", 1, msgNDATA, 254, seqOutOfOrder, 1},
+		{"gap", 10, msgNDATA, 13, seqGap, 13},
+		{"far behind is a gap", 200, msgNDATA, 10, seqGap, 10},
+		{"birth restarts the sequence", 10, msgNBIRTH, 0, seqOK, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newEdgeNode("spBv1.0", "G1", "N1")
+			node.checkSequence(msgNBIRTH, test.last)
+
+			if got := node.checkSequence(test.msgType, test.seq); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+
+			if node.seq != test.wantLast {
+				t.Errorf("last sequence %d, want %d", node.seq, test.wantLast)
+			}
+		})
+	}
+}
+
+func TestCheckSequenceFirstMessage(t *testing.T) {
+	node := newEdgeNode("spBv1.0", "G1", "N1")
+
+	// Joining in the middle of a session starts from whatever comes first
+	if got := node.checkSequence(msgDDATA, 42); got != seqOK {
+		t.Errorf("got %v, want seqOK", got)
+	}
+
+	if got := node.checkSequence(msgDDATA, 43); got != seqOK {
+		t.Errorf("got %v, want seqOK", got)
+	}
+}
+
+func TestCompleteMetric(t *testing.T) {
+	property := func(value uint32) *pb.Payload_PropertyValue {
+		return &pb.Payload_PropertyValue{
+			Type:  proto.Uint32(PBUInt32),
+			Value: &pb.Payload_PropertyValue_IntValue{IntValue: value},
+		}
+	}
+
+	node := newEdgeNode("spBv1.0", "G1", "N1")
+	node.storeBirth("D1", []*pb.Payload_Metric{{
+		Name:     proto.String("Temp"),
+		Alias:    proto.Uint64(1),
+		Datatype: proto.Uint32(PBFloat),
+		Properties: &pb.Payload_PropertySet{
+			Keys:   []string{"engHigh", "Quality"},
+			Values: []*pb.Payload_PropertyValue{property(100), property(0)},
+		},
+	}})
+
+	metric := &pb.Payload_Metric{Alias: proto.Uint64(1)}
+
+	if !node.resolveAlias("D1", metric) {
+		t.Fatal("alias not resolved")
+	}
+
+	node.completeMetric("D1", metric)
+
+	if metric.GetDatatype() != PBFloat {
+		t.Errorf("datatype %d, want %d", metric.GetDatatype(), PBFloat)
+	}
+
+	if _, found := getProperty(metric.GetProperties(), "engHigh"); !found {
+		t.Error("engHigh not inherited from the birth")
+	}
+
+	// The bad quality of the birth value does not stick to later values
+	if _, found := getQuality(metric.GetProperties()); found {
+		t.Error("Quality inherited from the birth")
+	}
+
+	metric = &pb.Payload_Metric{
+		Name: proto.String("Temp"),
+		Properties: &pb.Payload_PropertySet{
+			Keys:   []string{"Quality"},
+			Values: []*pb.Payload_PropertyValue{property(192)},
+		},
+	}
+	node.completeMetric("D1", metric)
+
+	if quality, _ := getQuality(metric.GetProperties()); quality != 192 {
+		t.Errorf("quality %g, want 192", quality)
+	}
+
+	if _, found := getProperty(metric.GetProperties(), "engHigh"); !found {
+		t.Error("engHigh not merged with the properties of the metric")
+	}
+}
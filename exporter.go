@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	oslog "log"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,10 +15,11 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 )
 
 var mutex sync.RWMutex
-var edgeNodeList map[string]bool
+var edgeNodeList map[string]*edgeNode
 
 // contants for various SP labels and metric names
 const (
@@ -25,17 +28,37 @@ const (
 	SPConnectionCount      string = "sp_connection_established_count"
 	SPDisconnectionCount   string = "sp_connection_lost_count"
 	SPPushInvalidMetric    string = "sp_invalid_metric_name_received"
+	SPUnknownAlias         string = "sp_unknown_alias_received"
+	SPEdgeNodeOnline       string = "sp_edge_node_online"
+	SPDeviceOnline         string = "sp_device_online"
 
 	SPReincarnationAttempts string = "sp_reincarnation_attempt_count"
 	SPReincarnationFailures string = "sp_reincarnation_failure_count"
 	SPReincarnationSuccess  string = "sp_reincarnation_success_count"
 	SPReincarnationDelay    string = "sp_reincarnation_delayed_count"
+	SPReincarnationManual   string = "sp_reincarnation_manual_count"
+
+	SPCommandSent     string = "sp_command_sent_count"
+	SPCommandFailures string = "sp_command_failure_count"
+
+	SPSequenceGap        string = "sp_sequence_gap_count"
+	SPSequenceDuplicate  string = "sp_sequence_duplicate_count"
+	SPSequenceOutOfOrder string = "sp_sequence_out_of_order_count"
+	SPStaleDeathIgnored  string = "sp_stale_death_ignored_count"
+	SPMessageBeforeBirth string = "sp_message_before_birth_count"
+
+	SPStringCardinalityExceeded string = "sp_string_cardinality_exceeded_count"
+	SPBadQuality                string = "sp_bad_quality_received"
+	SPHistoricalMetric          string = "sp_historical_metrics_received"
+	SPNullMetric                string = "sp_null_metrics_received"
+	SPMetricNameCollision       string = "sp_metric_name_collision_count"
+	SPRelabelDropped            string = "sp_relabel_dropped_count"
 
 	NewMetricString string = "Creating new SP metric %s\n"
 
-	SPReincarnateTimer  uint32 = 900
 	SPReincarnateRetry  uint32 = 60
 	SPReconnectionTimer uint32 = 300
+	SPSequenceRange     uint64 = 256
 	PBInt8              uint32 = 1
 	PBInt16             uint32 = 2
 	PBInt32             uint32 = 3
@@ -57,11 +80,50 @@ const (
 	PBTemplate          uint32 = 19
 	PBPropertySet       uint32 = 20
 	PBPropertySetList   uint32 = 21
+
+	// Sparkplug 3.0 array types, packed little endian into bytes_value
+	PBInt8Array     uint32 = 22
+	PBInt16Array    uint32 = 23
+	PBInt32Array    uint32 = 24
+	PBInt64Array    uint32 = 25
+	PBUInt8Array    uint32 = 26
+	PBUInt16Array   uint32 = 27
+	PBUInt32Array   uint32 = 28
+	PBUInt64Array   uint32 = 29
+	PBFloatArray    uint32 = 30
+	PBDoubleArray   uint32 = 31
+	PBBooleanArray  uint32 = 32
+	PBStringArray   uint32 = 33
+	PBDateTimeArray uint32 = 34
 )
 
+// The series of a metric are exposed as const metrics, so that they can
+// carry the timestamp of the Sparkplug metric
 type prometheusmetric struct {
-	prommetric *prometheus.GaugeVec
-	promlabel  []string
+	promdesc  *prometheus.Desc
+	promlabel []string
+	series    map[uint64]*promsample
+}
+
+type promsample struct {
+	labelValues prometheus.Labels
+	value       float64
+	timestamp   time.Time
+}
+
+// Where the metrics of a message came from, shared by all of them
+type metricSource struct {
+	node            *edgeNode
+	deviceID        string
+	topic           sparkplugTopic
+	siteLabels      []string
+	siteLabelValues prometheus.Labels
+
+	// Time of the metric being processed, zero when unknown
+	timestamp time.Time
+
+	// Historical metrics go to the backfill sink rather than live series
+	historical bool
 }
 
 type spplugExporter struct {
@@ -69,9 +131,28 @@ type spplugExporter struct {
 	versionDesc *prometheus.Desc
 	connectDesc *prometheus.Desc
 
-	// Holds the mertrics collected
-	metrics        map[string][]prometheusmetric
+	// Holds the mertrics collected, one per family name
+	metrics        map[string]*prometheusmetric
 	counterMetrics map[string]*prometheus.CounterVec
+	gaugeMetrics   map[string]*prometheus.GaugeVec
+
+	// Families split off a metric name with a different label set
+	splitFamilies map[string][]string
+
+	// Current string of each info series
+	infoValues map[seriesKey]string
+
+	// Current quality code of each metric with an sp_quality label
+	qualityCodes map[seriesKey]string
+
+	// HELP text of metrics that are documented in their properties
+	metricHelp map[string]string
+
+	// Source name of every sanitized metric name, to detect collisions
+	sanitizedNames map[string]string
+
+	backfill *backfillSink
+	rebirth  *rebirthScheduler
 }
 
 // Initialize
@@ -105,6 +186,11 @@ func initSparkPlugExporter(e **spplugExporter) {
 	// Set capabilities
 	options.SetAutoReconnect(true)
 
+	if isPrimaryHost() {
+		log.Infof("Acting as primary host application %s\n", *hostID)
+		setStateWill(options)
+	}
+
 	// create an exporter
 	*e = &spplugExporter{
 		versionDesc: prometheus.NewDesc(
@@ -122,6 +208,11 @@ func initSparkPlugExporter(e **spplugExporter) {
 
 	(*e).initializeMetricsAndData()
 
+	if *historicalMode == "backfill" {
+		(*e).backfill = newBackfillSink(*backfillDir)
+		go (*e).backfill.run(*backfillInterval)
+	}
+
 	if token := (*e).client.Connect(); token.Wait() && token.Error() != nil {
 		log.Fatal(token.Error())
 	}
@@ -129,6 +220,23 @@ func initSparkPlugExporter(e **spplugExporter) {
 	(*e).client.Subscribe(*topic, 2, (*e).receiveMessage())
 }
 
+// Graceful shutdown, as a primary host we have to announce that we are going
+// offline since the broker only sends the will when the connection is lost
+func (e *spplugExporter) shutdown() {
+	if isPrimaryHost() && e.client.IsConnectionOpen() {
+		e.client.Unsubscribe(getStateTopic()).Wait()
+		publishState(e.client, false)
+	}
+
+	e.client.Disconnect(250)
+
+	if e.backfill != nil {
+		if err := e.backfill.flush(); err != nil {
+			log.Errorf("Error writing backfill file: %v\n", err)
+		}
+	}
+}
+
 func (e *spplugExporter) Describe(ch chan<- *prometheus.Desc) {
 	mutex.RLock()
 	defer mutex.RUnlock()
@@ -137,11 +245,11 @@ func (e *spplugExporter) Describe(ch chan<- *prometheus.Desc) {
 	for _, m := range e.counterMetrics {
 		m.Describe(ch)
 	}
-	for k := range e.metrics {
-		for _, ma := range e.metrics[k] {
-			ma.prommetric.Describe(ch)
-		}
-
+	for _, m := range e.gaugeMetrics {
+		m.Describe(ch)
+	}
+	for _, m := range e.metrics {
+		ch <- m.promdesc
 	}
 }
 
@@ -169,12 +277,70 @@ func (e *spplugExporter) Collect(ch chan<- prometheus.Metric) {
 		m.Collect(ch)
 	}
 
-	for k := range e.metrics {
-		for _, ma := range e.metrics[k] {
-			ma.prommetric.Collect(ch)
+	for _, m := range e.gaugeMetrics {
+		m.Collect(ch)
+	}
+
+	for _, m := range e.metrics {
+		m.collect(ch)
+	}
+}
+
+func (m *prometheusmetric) collect(ch chan<- prometheus.Metric) {
+	for _, sample := range m.series {
+		labelValues := make([]string, 0, len(m.promlabel))
+
+		for _, label := range m.promlabel {
+			labelValues = append(labelValues, sample.labelValues[label])
+		}
+
+		metric, err := prometheus.NewConstMetric(m.promdesc,
+			prometheus.GaugeValue, sample.value, labelValues...)
+
+		if err != nil {
+			log.Debugf("Error %v collecting %s\n", err, m.promdesc)
+			continue
+		}
+
+		if *useTimestamps && !sample.timestamp.IsZero() {
+			metric = prometheus.NewMetricWithTimestamp(sample.timestamp,
+				metric)
+		}
+
+		ch <- metric
+	}
+}
+
+// Set the value of a series, unless it already holds a newer sample.  A zero
+// timestamp means the time of the sample is not known, such a sample (or a
+// NaN marking the series stale) always replaces the current one.
+func (m *prometheusmetric) set(labelValues prometheus.Labels, value float64,
+	timestamp time.Time) bool {
+
+	signature := getSeriesSignature(labelValues)
+	sample, exists := m.series[signature]
+
+	if !exists {
+		m.series[signature] = &promsample{
+			labelValues: labelValues,
+			value:       value,
+			timestamp:   timestamp,
 		}
+		return true
+	}
 
+	if *useTimestamps && !timestamp.IsZero() &&
+		timestamp.Before(sample.timestamp) {
+		return false
 	}
+
+	sample.value = value
+	sample.timestamp = timestamp
+	return true
+}
+
+func (m *prometheusmetric) delete(labelValues prometheus.Labels) {
+	delete(m.series, getSeriesSignature(labelValues))
 }
 
 func (e *spplugExporter) receiveMessage() func(mqtt.Client, mqtt.Message) {
@@ -182,8 +348,25 @@ func (e *spplugExporter) receiveMessage() func(mqtt.Client, mqtt.Message) {
 		mutex.Lock()
 		defer mutex.Unlock()
 
-		var   pbMsg pb.Payload
-		var   eventString string
+		var pbMsg pb.Payload
+
+		topic := m.Topic()
+		log.Debugf("Received message: %s\n", topic)
+
+		// 6.1.3 covers 9 message types, only births, deaths and data carry
+		// metrics
+		spTopic, err := parseTopic(trimTopicPrefix(topic))
+
+		if err != nil {
+			log.Debugf("Ignoring topic, does not comply with Sparkspec: %v\n",
+				err)
+			return
+		}
+
+		if !spTopic.msgType.isMetric() {
+			log.Debugf("Ignoring non-metric data: %s\n", spTopic.msgType)
+			return
+		}
 
 		// Unmarshal MQTT message into Google Protocol Buffer
 		if err := proto.Unmarshal(m.Payload(), &pbMsg); err != nil {
@@ -191,114 +374,501 @@ func (e *spplugExporter) receiveMessage() func(mqtt.Client, mqtt.Message) {
 			return
 		}
 
-		topic := m.Topic()
-		log.Debugf("Received message: %s\n", topic)
 		log.Debugf("%s\n", pbMsg.String())
 
 		// Get the labels and value for the labels from the topic and constants
-		siteLabels, siteLabelValues, processMetric := prepareLabelsAndValues(topic)
+		siteLabels, siteLabelValues := prepareLabelsAndValues(spTopic)
+		msgType := spTopic.msgType
+		deviceID := spTopic.deviceID
+
+		// A death certificate for an edge node we never heard from has
+		// nothing to clean up
+		if msgType == msgNDEATH || msgType == msgDDEATH {
+			node, exists := edgeNodeList[edgeNodeKey(
+				siteLabelValues[SPGroupID], siteLabelValues[SPEdgeNodeID])]
+
+			if !exists {
+				return
+			}
+
+			if msgType == msgDDEATH {
+				e.evaluateSequence(node, msgType, &pbMsg)
+			} else if !node.isCurrentDeath(pbMsg.GetMetrics()) {
+				log.Infof("Ignoring NDEATH from %s/%s for a previous session\n",
+					node.group, node.nodeID)
+				e.counterMetrics[SPStaleDeathIgnored].
+					With(node.getNodeLabelValues()).Inc()
+				return
+			}
+
+			e.processDeath(node, deviceID)
 
-		if !processMetric {
 			return
 		}
 
 		// Process this edge node, if it is unique start the re-birth process
-		e.evaluateEdgeNode(c, siteLabelValues["sp_namespace"],
+		node := e.evaluateEdgeNode(c, siteLabelValues["sp_namespace"],
 			siteLabelValues["sp_group_id"],
 			siteLabelValues["sp_edge_node_id"])
 
+		e.evaluateSequence(node, msgType, &pbMsg)
+
+		if !e.evaluateBirthOrder(node, msgType, deviceID, siteLabelValues) {
+			return
+		}
+
 		metricList := pbMsg.GetMetrics()
 		log.Debugf("Received message in processMetric: %s\n", metricList)
 
-		for _, metric := range metricList {
+		switch msgType {
+		case msgNBIRTH:
+			node.storeBirth(deviceID, metricList)
+			node.storeBdSeq(metricList)
+			node.storeTemplates(metricList)
+			e.rebirth.birth(node)
+			node.online = true
+			e.gaugeMetrics[SPEdgeNodeOnline].
+				With(node.getNodeLabelValues()).Set(1)
+		case msgDBIRTH:
+			node.storeBirth(deviceID, metricList)
+			node.getDevice(deviceID).online = true
+			e.gaugeMetrics[SPDeviceOnline].
+				With(node.getDeviceLabelValues(deviceID)).Set(1)
+		}
+
+		source := metricSource{
+			topic:           spTopic,
+			node:            node,
+			deviceID:        deviceID,
+			siteLabels:      siteLabels,
+			siteLabelValues: siteLabelValues,
+		}
 
-			var newMetric prometheusmetric
-			metricLabels := siteLabels
-			metricLabelValues := cloneLabelSet(siteLabelValues)
+		unknownAlias := false
 
-			newLabelname, metricName, err := getMetricName(metric)
+		for _, metric := range metricList {
 
-			if newLabelname != nil {
-				for list := 0; list < len(newLabelname); list++ {
-					parts := strings.Split(newLabelname[list], ":")
+			if !node.resolveAlias(deviceID, metric) {
+				log.Warnf("Unknown alias %d from %s\n", metric.GetAlias(),
+					topic)
+				e.counterMetrics[SPUnknownAlias].With(siteLabelValues).Inc()
+				unknownAlias = true
+				continue
+			}
 
-					metricLabels = append(metricLabels, parts[0])
-					metricLabelValues[parts[0]] = string(parts[1])
+			node.completeMetric(deviceID, metric)
+			source.timestamp = getMetricTimestamp(metric, &pbMsg)
+			source.historical = false
+
+			// Replayed store and forward data must not overwrite the live
+			// values
+			if metric.GetIsHistorical() {
+				e.counterMetrics[SPHistoricalMetric].
+					With(siteLabelValues).Inc()
+
+				switch *historicalMode {
+				case "drop":
+					continue
+				case "backfill":
+					source.historical = true
 				}
 			}
 
-			if err != nil {
-				if metricName != "Device Control/Rebirth" {
-					log.Errorf("Error: %s %s %v  \n", siteLabelValues["sp_edge_node_id"], metricName, err)
-					e.counterMetrics[SPPushInvalidMetric].With(siteLabelValues).Inc()
-				}
+			e.processMetric(&source, metric)
+		}
+
+		// We missed (or never saw) the birth certificate for this session,
+		// so ask the edge node to publish a new one
+		if unknownAlias {
+			e.rebirth.request(node, SPRebirthUnknownAlias)
+		}
+	}
+}
+
+// Sparkplug 3.0 does not allow data from an edge node (or device) before its
+// birth certificate, we can't make sense of it without the birth anyway.
+// Returns false if the message has to be dropped, in which case the edge
+// node is asked for a rebirth.
+func (e *spplugExporter) evaluateBirthOrder(node *edgeNode, msgType messageType,
+	deviceID string, siteLabelValues prometheus.Labels) bool {
+
+	if *sparkplugVersion != "3" || msgType == msgNBIRTH {
+		return true
+	}
+
+	if node.online {
+		if msgType != msgDDATA || node.getDevice(deviceID).online {
+			return true
+		}
+	}
+
+	log.Warnf("Dropping %s from %s/%s/%s received before its birth\n",
+		msgType, node.group, node.nodeID, deviceID)
+	e.counterMetrics[SPMessageBeforeBirth].With(siteLabelValues).Inc()
+	e.rebirth.request(node, SPRebirthBirthOrder)
+
+	return false
+}
+
+// Convert a single metric from a message to time series
+func (e *spplugExporter) processMetric(source *metricSource,
+	metric *pb.Payload_Metric) {
+
+	siteLabelValues := source.siteLabelValues
+	metricLabels := source.siteLabels
+	metricLabelValues := cloneLabelSet(siteLabelValues)
+
+	folders, metricName := getMetricName(metric)
+
+	metricName, metricLabels, metricLabelValues =
+		getFolderRule(source.topic).apply(folders, metricName, metricLabels,
+			metricLabelValues)
+
+	originalName := metricName
+
+	if *metricNameMode == "sanitize" &&
+		!model.IsValidMetricName(model.LabelValue(metricName)) &&
+		originalName != "Device Control/Rebirth" {
+		metricName = sanitizeMetricName(metricName)
+	}
+
+	if !model.IsValidMetricName(model.LabelValue(metricName)) {
+		if metricName != "Device Control/Rebirth" {
+			log.Errorf("Error: %s %s %v  \n", siteLabelValues["sp_edge_node_id"], metricName, "Non-compliant metric name")
+			e.counterMetrics[SPPushInvalidMetric].With(siteLabelValues).Inc()
+		}
+
+		return
+	}
+
+	if *metricNameMode == "sanitize" &&
+		!e.checkNameCollision(originalName, metricName, siteLabelValues) {
+		return
+	}
+
+	metricLabels, metricLabelValues = addOriginalNameLabel(metric.GetName(),
+		metricLabels, metricLabelValues)
+
+	metricName, metricLabels, metricLabelValues, keep := relabelMetric(
+		metricName, metricLabels, metricLabelValues)
+
+	if !keep {
+		log.Debugf("Metric %s dropped by relabeling\n", originalName)
+		e.counterMetrics[SPRelabelDropped].With(siteLabelValues).Inc()
+		return
+	}
+
+	if !model.IsValidMetricName(model.LabelValue(metricName)) {
+		log.Errorf("Error: %s %s %v  \n", siteLabelValues["sp_edge_node_id"], metricName, "Non-compliant metric name after relabeling")
+		e.counterMetrics[SPPushInvalidMetric].With(siteLabelValues).Inc()
+		return
+	}
+
+	e.exportMetric(source, metric, metricName, metricLabels,
+		metricLabelValues)
+}
+
+// Export the value of a metric once its name and labels are known, complex
+// types (DataSet, Template) expand into several metrics
+func (e *spplugExporter) exportMetric(source *metricSource,
+	metric *pb.Payload_Metric, metricName string, metricLabels []string,
+	metricLabelValues prometheus.Labels) {
+
+	if isDateTimeDatatype(metric.GetDatatype()) {
+		metricName = getTimestampMetricName(metricName)
+	}
+
+	e.storeHelp(metric, metricName)
+	metricLabels, metricLabelValues = addPropertyLabels(
+		metric.GetProperties(), metricLabels, metricLabelValues)
+
+	if metric.GetIsNull() {
+		e.processNull(source, metric, metricName, metricLabelValues)
+		return
+	}
+
+	if metric.GetDatatype() == PBTemplate {
+		e.exportTemplate(source, metric.GetTemplateValue(), metricName,
+			metricLabels, metricLabelValues)
+		return
+	}
+
+	if metric.GetDatatype() == PBDataSet {
+		e.exportDataSet(source, metric.GetDatasetValue(), metricName,
+			metricLabels, metricLabelValues)
+		return
+	}
+
+	if isStringDatatype(metric.GetDatatype()) && *stringMode == "info" {
+		e.exportInfo(source, metric, metricName, metricLabels,
+			metricLabelValues)
+		return
+	}
+
+	metricVals, err := convertMetricValues(metric)
+
+	if err != nil {
+		log.Debugf("Error %v converting data type for metric %s\n",
+			err, metricName)
+		return
+	}
+
+	quality, hasQuality := getQuality(metric.GetProperties())
+
+	if hasQuality && !e.evaluateQuality(source, metricName, quality,
+		metricLabels, metricLabelValues, metricVals) {
+		return
+	}
+
+	// The engineering range does not depend on the quality of the value
+	limitLabels, limitLabelValues := metricLabels, metricLabelValues
+
+	if *qualityMode == "label" {
+		metricLabels, metricLabelValues = e.addQualityLabel(source,
+			metricName, metricLabels, metricLabelValues, quality, hasQuality)
+	}
+
+	if metric.GetDatatype() == PBBoolean && *booleanMode == "stateset" {
+		e.exportStateSet(source, metricName, metricLabels, metricLabelValues,
+			metricVals[0] == 1)
+		return
+	}
+
+	// Every element of an array gets its own series
+	if !isArrayDatatype(metric.GetDatatype()) {
+		e.exportSeries(source, metricName, metricLabels, metricLabelValues,
+			metricVals[0])
+		e.exportLimits(source, metric, metricName, limitLabels,
+			limitLabelValues)
+		return
+	}
+
+	metricLabels = append(metricLabels, SPArrayIndex)
+
+	for index, metricVal := range metricVals {
+		elementLabelValues := cloneLabelSet(metricLabelValues)
+		elementLabelValues[SPArrayIndex] = strconv.Itoa(index)
+
+		e.exportSeries(source, metricName, metricLabels, elementLabelValues,
+			metricVal)
+	}
+}
+
+// Export the quality of a metric and decide what to do with its value.
+// Returns false if the value has to be dropped, values to be marked stale are
+// replaced with NaN.
+func (e *spplugExporter) evaluateQuality(source *metricSource,
+	metricName string, quality float64, metricLabels []string,
+	metricLabelValues prometheus.Labels, metricVals []float64) bool {
+
+	if *qualityMode == "gauge" {
+		e.exportSeries(source, metricName+"_quality", metricLabels,
+			metricLabelValues, quality)
+	}
+
+	if !isBadQuality(quality) {
+		return true
+	}
+
+	log.Debugf("Bad quality (%g) for metric %s\n", quality, metricName)
+	e.counterMetrics[SPBadQuality].With(source.siteLabelValues).Inc()
+
+	switch *badQuality {
+	case "drop":
+		return false
+	case "stale":
+		for index := range metricVals {
+			metricVals[index] = math.NaN()
+		}
+	}
+
+	return true
+}
+
+// OpenMetrics StateSet, one series per state with a label named after the
+// metric, the current state is 1 and the other 0
+func (e *spplugExporter) exportStateSet(source *metricSource,
+	metricName string, metricLabels []string,
+	metricLabelValues prometheus.Labels, state bool) {
+
+	stateLabel := strings.Replace(metricName, ":", "_", -1)
+	metricLabels = append(metricLabels, stateLabel)
+
+	for _, value := range []bool{true, false} {
+		stateLabelValues := cloneLabelSet(metricLabelValues)
+		stateLabelValues[stateLabel] = strconv.FormatBool(value)
+
+		metricVal := float64(0)
+		if value == state {
+			metricVal = 1
+		}
+
+		e.exportSeries(source, metricName, metricLabels, stateLabelValues,
+			metricVal)
+	}
+}
+
+// Set the value of a time series published by the source edge node / device
+func (e *spplugExporter) exportSeries(source *metricSource, metricName string,
+	metricLabels []string, metricLabelValues prometheus.Labels,
+	metricVal float64) {
 
+	siteLabelValues := source.siteLabelValues
+
+	if source.historical {
+		if source.timestamp.IsZero() {
+			log.Debugf("Ignoring historical metric %s without timestamp\n",
+				metricName)
+			return
+		}
+
+		e.backfill.add(metricName, e.getHelp(metricName), metricLabelValues,
+			metricVal, source.timestamp)
+		return
+	}
+
+	familyName, eventString := e.setMetric(metricName, metricLabels,
+		metricLabelValues, metricVal, source.timestamp)
+
+	source.node.trackSeries(source.deviceID, familyName, metricLabelValues)
+
+	log.Infof("%s: name (%s) value (%g) labels: (%s)\n",
+		eventString, familyName, metricVal, metricLabelValues)
+
+	log.Debugf("metriclabels: (%s) siteLabelValues: (%s)\n",
+		metricLabels, siteLabelValues)
+
+	e.gaugeMetrics[SPLastTimePushedMetric].With(siteLabelValues).SetToCurrentTime()
+	e.counterMetrics[SPPushTotalMetric].With(siteLabelValues).Inc()
+}
+
+// Set the value of a time series, creating the metric if this is the first
+// time we have seen this name and label set.  Returns the name of the family
+// the series ended up in along with what was done for logging.
+func (e *spplugExporter) setMetric(metricName string, metricLabels []string,
+	metricLabelValues prometheus.Labels, metricVal float64,
+	timestamp time.Time) (string, string) {
+
+	// Each metric name has a single label schema, label sets that don't
+	// fit it grow the schema or are split off into a family of their own
+	familyName, family, eventString := e.getFamily(metricName, metricLabels)
+
+	// Samples buffered at the edge can arrive after newer ones
+	if !family.set(metricLabelValues, metricVal, timestamp) {
+		eventString = "Ignoring older sample for metric"
+	}
+
+	return familyName, eventString
+}
+
+// Remove a time series, if it exists
+func (e *spplugExporter) deleteSeries(source *metricSource, metricName string,
+	metricLabels []string, metricLabelValues prometheus.Labels) {
+
+	familyName, family := e.findFamily(metricName, metricLabels)
+
+	if family == nil {
+		return
+	}
+
+	log.Infof("Deleting metric: name (%s) labels: (%s)\n", familyName,
+		metricLabelValues)
+
+	family.delete(metricLabelValues)
+	source.node.untrackSeries(source.deviceID, familyName, metricLabelValues)
+}
+
+// A null metric has no value, rather than reporting the 0 its value fields
+// default to, the series are removed or keep their previous value
+func (e *spplugExporter) processNull(source *metricSource,
+	metric *pb.Payload_Metric, metricName string,
+	metricLabelValues prometheus.Labels) {
+
+	log.Debugf("Null value for metric %s labels: (%s)\n", metricName,
+		metricLabelValues)
+	e.counterMetrics[SPNullMetric].With(source.siteLabelValues).Inc()
+
+	if *nullPolicy == "keep" || source.historical {
+		return
+	}
+
+	if isStringDatatype(metric.GetDatatype()) {
+		metricName = getInfoMetricName(metricName)
+	}
+
+	e.deleteMatchingSeries(source, metricName, metricLabelValues)
+}
+
+// Remove every series of a metric that has the given label values, whatever
+// other labels it has (array index, state ...)
+func (e *spplugExporter) deleteMatchingSeries(source *metricSource,
+	metricName string, metricLabelValues prometheus.Labels) {
+
+	for _, familyName := range e.getFamilyNames(metricName) {
+		metric := e.metrics[familyName]
+
+		for _, sample := range metric.series {
+			if !isLabelSubset(metricLabelValues, sample.labelValues) {
 				continue
 			}
 
-			// if metricName is not within the e.metrics OR
-			// if metricLabels (note you will need a function to compare maps) is not within e.metrics[metricName], then you need to create a new metric
-			_, metricNameExists := e.metrics[metricName]
-			var labelIndex int
-			var labelSetExists bool
+			log.Infof("Deleting metric: name (%s) labels: (%s)\n",
+				familyName, sample.labelValues)
 
-			// If the metric name exists in the map, that means that we
-			// have seen this metric before.   However due to the customized
-			// label support, it's possible that we can use an existing metric
-			// or need to create a new one.
+			metric.delete(sample.labelValues)
+			source.node.untrackSeries(source.deviceID, familyName,
+				sample.labelValues)
+		}
+	}
+}
 
-			if metricNameExists {
-				// Each entry under a metricName contains a set of label names
-				// and a pointer to the metric.   This is what makes a time
-				// series unique, so if the label names we received are not
-				// contained in the list, we need to create a new entry
+// Handle a death certificate.  Nothing will update the series published by
+// the edge node (or device) until it is born again, so depending on the
+// configured policy they are either removed or marked stale.
+func (e *spplugExporter) processDeath(node *edgeNode, deviceID string) {
+	if deviceID != "" {
+		log.Infof("Device %s/%s/%s is offline\n", node.group, node.nodeID,
+			deviceID)
+
+		device := node.getDevice(deviceID)
+		device.online = false
+		e.expireSeries(device.series)
+		device.series = make(map[seriesKey]seriesRef)
+
+		e.gaugeMetrics[SPDeviceOnline].
+			With(node.getDeviceLabelValues(deviceID)).Set(0)
+		return
+	}
 
-				labelSetExists, labelIndex = compareLabelSet(e.metrics[metricName],
-					metricLabels)
+	log.Infof("Edge node %s/%s is offline\n", node.group, node.nodeID)
 
-				// If the labels are not there, we create a new metric.
-				// If they are we update an existing metric
-				if !labelSetExists {
+	e.expireSeries(node.series)
+	node.series = make(map[seriesKey]seriesRef)
 
-					eventString = "Creating new timeseries for existing metric"
-					newMetric.promlabel = append(newMetric.promlabel,
-						metricLabels...)
+	// The devices go down along with their edge node
+	node.online = false
 
-					newMetric.prommetric = createNewMetric(metricName,
-						metricLabels)
+	for id, device := range node.devices {
+		device.online = false
+		e.expireSeries(device.series)
+		device.series = make(map[seriesKey]seriesRef)
 
-					labelIndex = len(e.metrics[metricName])
+		e.gaugeMetrics[SPDeviceOnline].
+			With(node.getDeviceLabelValues(id)).Set(0)
+	}
 
-					e.metrics[metricName] = append(e.metrics[metricName],
-						newMetric)
-				} else {
-					eventString = "Updating metric"
-					e.metrics[metricName][labelIndex].promlabel = metricLabels
-				}
-			} else {
-				eventString = "Creating metric"
-				newMetric.promlabel = append(newMetric.promlabel,
-					metricLabels...)
-				newMetric.prommetric = createNewMetric(metricName,
-					metricLabels)
-				labelIndex = 0
-				e.metrics[metricName] = append(e.metrics[metricName],
-					newMetric)
-			}
-			if metricVal, err := convertMetricToFloat(metric); err != nil {
-				log.Debugf("Error %v converting data type for metric %s\n",
-					err, metricName)
-			} else {
-				log.Infof("%s: name (%s) value (%g) labels: (%s)\n",
-					eventString, metricName, metricVal, metricLabelValues)
-
-				log.Debugf("metriclabels: (%s) siteLabelValues: (%s)\n",
-					metricLabels, siteLabelValues)
-
-				e.metrics[metricName][labelIndex].prommetric.With(metricLabelValues).Set(metricVal)
-				e.metrics[SPLastTimePushedMetric][0].prommetric.With(siteLabelValues).SetToCurrentTime()
-				e.counterMetrics[SPPushTotalMetric].With(siteLabelValues).Inc()
-			}
+	e.gaugeMetrics[SPEdgeNodeOnline].With(node.getNodeLabelValues()).Set(0)
+	e.rebirth.forget(node)
+}
+
+func (e *spplugExporter) expireSeries(series map[seriesKey]seriesRef) {
+	for _, ref := range series {
+		metric := e.metrics[ref.metricName]
+
+		if *deathPolicy == "stale" {
+			metric.set(ref.labelValues, math.NaN(), time.Time{})
+		} else {
+			metric.delete(ref.labelValues)
 		}
 	}
 }
@@ -308,74 +878,117 @@ func (e *spplugExporter) receiveMessage() func(mqtt.Client, mqtt.Message) {
 // the metrics / tags
 
 func (e *spplugExporter) evaluateEdgeNode(c mqtt.Client, namespace string,
-	group string, nodeID string) {
+	group string, nodeID string) *edgeNode {
+
+	key := edgeNodeKey(group, nodeID)
 
-	edgeNode := group + "/" + nodeID
+	node, exists := edgeNodeList[key]
 
-	if _, exists := edgeNodeList[edgeNode]; !exists {
-		edgeNodeList[edgeNode] = true
-		e.reincarnate(namespace, group, nodeID)
+	if !exists {
+		node = newEdgeNode(namespace, group, nodeID)
+		edgeNodeList[key] = node
+		e.rebirth.requestFirstSight(node)
 	} else {
-		log.Debugf("Known edge node: %s\n", edgeNode)
+		log.Debugf("Known edge node: %s\n", key)
 	}
+
+	return node
 }
 
-func (e *spplugExporter) reincarnate(namespace string, group string,
-	nodeID string) {
-	go func() {
-		var pbMsg pb.Payload
-		var pbMetric pb.Payload_Metric
-		var pbMetricList []*pb.Payload_Metric
-		var pbValue pb.Payload_Metric_BooleanValue
+// Check the sequence number of the message and account for anything missing
+// or out of place.  A gap means we lost messages (and possibly a birth), so
+// the edge node is asked for a rebirth when configured to do so.
+func (e *spplugExporter) evaluateSequence(node *edgeNode, msgType messageType,
+	pbMsg *pb.Payload) {
 
-		_, labelValues := getNodeLabelSetandValues(namespace, group, nodeID)
+	if pbMsg.Seq == nil {
+		return
+	}
 
-		metricName := "Node Control/Rebirth"
-		dataType := PBBoolean
+	lastSeq := node.seq
+	labelValues := node.getNodeLabelValues()
 
-		pbValue.BooleanValue = true
-		pbMetric.Name = &metricName
-		pbMetric.Datatype = &dataType
-		pbMetric.Value = &pbValue
+	switch node.checkSequence(msgType, pbMsg.GetSeq()) {
+	case seqGap:
+		log.Warnf("Sequence gap from %s/%s: expected %d, received %d\n",
+			node.group, node.nodeID, (lastSeq+1)%SPSequenceRange,
+			pbMsg.GetSeq())
+		e.counterMetrics[SPSequenceGap].With(labelValues).Inc()
 
-		pbMetricList = append(pbMetricList, &pbMetric)
-		pbMsg.Metrics = pbMetricList
+		if *rebirthOnGap {
+			e.rebirth.request(node, SPRebirthSequenceGap)
+		}
+	case seqDuplicate:
+		log.Debugf("Duplicate sequence %d from %s/%s\n", pbMsg.GetSeq(),
+			node.group, node.nodeID)
+		e.counterMetrics[SPSequenceDuplicate].With(labelValues).Inc()
+	case seqOutOfOrder:
+		log.Debugf("Out of order sequence %d from %s/%s, last was %d\n",
+			pbMsg.GetSeq(), node.group, node.nodeID, lastSeq)
+		e.counterMetrics[SPSequenceOutOfOrder].With(labelValues).Inc()
+	}
+}
 
-		topic := namespace + "/" + group + "/NCMD/" + nodeID
+// Publish a Node Control/Rebirth NCMD to the edge node, returns false if
+// the message could not be sent
+func (e *spplugExporter) sendRebirth(namespace string, group string,
+	nodeID string) bool {
+	var pbMsg pb.Payload
+	var pbMetric pb.Payload_Metric
+	var pbMetricList []*pb.Payload_Metric
+	var pbValue pb.Payload_Metric_BooleanValue
 
-		for true {
-			if e.client.IsConnectionOpen() {
-				log.Infof("Reincarnate: %s\n", topic)
+	_, labelValues := getNodeLabelSetandValues(namespace, group, nodeID)
 
-				e.counterMetrics[SPReincarnationAttempts].
-					With(labelValues).Inc()
+	metricName := "Node Control/Rebirth"
+	dataType := PBBoolean
 
-				timestamp := uint64(time.Now().UnixNano() / 1000000)
-				pbMsg.Timestamp = &timestamp
+	pbValue.BooleanValue = true
+	pbMetric.Name = &metricName
+	pbMetric.Datatype = &dataType
+	pbMetric.Value = &pbValue
 
-				if sendMQTTMsg(e.client, &pbMsg, topic) {
-					e.counterMetrics[SPReincarnationSuccess].
-						With(labelValues).Inc()
-				} else {
-					e.counterMetrics[SPReincarnationFailures].
-						With(labelValues).Inc()
-				}
+	pbMetricList = append(pbMetricList, &pbMetric)
+	pbMsg.Metrics = pbMetricList
 
-				time.Sleep(time.Duration(SPReincarnateTimer) * time.Second)
-			} else {
-				e.counterMetrics[SPReincarnationDelay].With(labelValues).Inc()
-				time.Sleep(time.Duration(SPReincarnateRetry) * time.Second)
-			}
-		}
-	}()
+	topic := newNodeTopic(namespace, group, msgNCMD, nodeID).String()
+
+	if !e.client.IsConnectionOpen() {
+		e.counterMetrics[SPReincarnationDelay].With(labelValues).Inc()
+		return false
+	}
+
+	log.Infof("Reincarnate: %s\n", topic)
+
+	e.counterMetrics[SPReincarnationAttempts].With(labelValues).Inc()
+
+	timestamp := uint64(time.Now().UnixNano() / 1000000)
+	pbMsg.Timestamp = &timestamp
+
+	if sendMQTTMsg(e.client, &pbMsg, topic) {
+		e.counterMetrics[SPReincarnationSuccess].With(labelValues).Inc()
+		return true
+	}
+
+	e.counterMetrics[SPReincarnationFailures].With(labelValues).Inc()
+	return false
 }
 
 func (e *spplugExporter) initializeMetricsAndData() {
 
-	e.metrics = make(map[string][]prometheusmetric)
+	e.metrics = make(map[string]*prometheusmetric)
+	e.splitFamilies = make(map[string][]string)
 	e.counterMetrics = make(map[string]*prometheus.CounterVec)
+	e.gaugeMetrics = make(map[string]*prometheus.GaugeVec)
+	e.infoValues = make(map[seriesKey]string)
+	e.qualityCodes = make(map[seriesKey]string)
+	e.metricHelp = make(map[string]string)
+	e.sanitizedNames = make(map[string]string)
+
+	e.rebirth = newRebirthScheduler(e)
+	go e.rebirth.run()
 
-	edgeNodeList = make(map[string]bool)
+	edgeNodeList = make(map[string]*edgeNode)
 
 	siteLabels := getLabelSet()
 	serviceLabels, _ := getServiceLabelSetandValues()
@@ -392,15 +1005,13 @@ func (e *spplugExporter) initializeMetricsAndData() {
 	)
 
 	log.Debugf(NewMetricString, SPLastTimePushedMetric)
-	var test prometheusmetric
-	test.prommetric = prometheus.NewGaugeVec(
+	e.gaugeMetrics[SPLastTimePushedMetric] = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: SPLastTimePushedMetric,
 			Help: fmt.Sprintf("Last time a metric was pushed to a MQTT topic"),
 		},
 		siteLabels,
 	)
-	e.metrics[SPLastTimePushedMetric] = append(e.metrics[SPLastTimePushedMetric], test)
 
 	log.Debugf(NewMetricString, SPPushInvalidMetric)
 
@@ -412,6 +1023,176 @@ func (e *spplugExporter) initializeMetricsAndData() {
 		siteLabels,
 	)
 
+	log.Debugf(NewMetricString, SPUnknownAlias)
+
+	e.counterMetrics[SPUnknownAlias] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPUnknownAlias,
+			Help: fmt.Sprintf("Total metrics received with an alias not declared in a birth certificate"),
+		},
+		siteLabels,
+	)
+
+	log.Debugf(NewMetricString, SPReincarnationManual)
+
+	e.counterMetrics[SPReincarnationManual] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPReincarnationManual,
+			Help: fmt.Sprintf("Total NCMD messages requested through the admin API"),
+		},
+		edgeNodeLabels,
+	)
+
+	log.Debugf(NewMetricString, SPCommandSent)
+
+	e.counterMetrics[SPCommandSent] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPCommandSent,
+			Help: fmt.Sprintf("Total NCMD/DCMD messages published through the command API"),
+		},
+		edgeNodeLabels,
+	)
+
+	log.Debugf(NewMetricString, SPCommandFailures)
+
+	e.counterMetrics[SPCommandFailures] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPCommandFailures,
+			Help: fmt.Sprintf("Total NCMD/DCMD messages the command API failed to publish"),
+		},
+		edgeNodeLabels,
+	)
+
+	log.Debugf(NewMetricString, SPMetricNameCollision)
+
+	e.counterMetrics[SPMetricNameCollision] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPMetricNameCollision,
+			Help: fmt.Sprintf("Total metrics whose sanitized name belongs to another metric"),
+		},
+		siteLabels,
+	)
+
+	log.Debugf(NewMetricString, SPRelabelDropped)
+
+	e.counterMetrics[SPRelabelDropped] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPRelabelDropped,
+			Help: fmt.Sprintf("Total metrics dropped by the relabeling rules"),
+		},
+		siteLabels,
+	)
+
+	log.Debugf(NewMetricString, SPSequenceGap)
+
+	e.counterMetrics[SPSequenceGap] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPSequenceGap,
+			Help: fmt.Sprintf("Total messages received after a gap in the sequence number"),
+		},
+		edgeNodeLabels,
+	)
+
+	log.Debugf(NewMetricString, SPSequenceDuplicate)
+
+	e.counterMetrics[SPSequenceDuplicate] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPSequenceDuplicate,
+			Help: fmt.Sprintf("Total messages received with a repeated sequence number"),
+		},
+		edgeNodeLabels,
+	)
+
+	log.Debugf(NewMetricString, SPSequenceOutOfOrder)
+
+	e.counterMetrics[SPSequenceOutOfOrder] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPSequenceOutOfOrder,
+			Help: fmt.Sprintf("Total messages received with an older sequence number"),
+		},
+		edgeNodeLabels,
+	)
+
+	log.Debugf(NewMetricString, SPStaleDeathIgnored)
+
+	e.counterMetrics[SPStaleDeathIgnored] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPStaleDeathIgnored,
+			Help: fmt.Sprintf("Total NDEATH messages ignored because their bdSeq does not match the current session"),
+		},
+		edgeNodeLabels,
+	)
+
+	log.Debugf(NewMetricString, SPMessageBeforeBirth)
+
+	e.counterMetrics[SPMessageBeforeBirth] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPMessageBeforeBirth,
+			Help: fmt.Sprintf("Total messages dropped because they arrived before the birth certificate (Sparkplug 3.0)"),
+		},
+		siteLabels,
+	)
+
+	log.Debugf(NewMetricString, SPStringCardinalityExceeded)
+
+	e.counterMetrics[SPStringCardinalityExceeded] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPStringCardinalityExceeded,
+			Help: fmt.Sprintf("Total string values dropped because their metric has too many distinct values"),
+		},
+		siteLabels,
+	)
+
+	log.Debugf(NewMetricString, SPBadQuality)
+
+	e.counterMetrics[SPBadQuality] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPBadQuality,
+			Help: fmt.Sprintf("Total metrics received with a bad quality code"),
+		},
+		siteLabels,
+	)
+
+	log.Debugf(NewMetricString, SPHistoricalMetric)
+
+	e.counterMetrics[SPHistoricalMetric] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPHistoricalMetric,
+			Help: fmt.Sprintf("Total historical (store and forward) metrics received"),
+		},
+		siteLabels,
+	)
+
+	log.Debugf(NewMetricString, SPNullMetric)
+
+	e.counterMetrics[SPNullMetric] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SPNullMetric,
+			Help: fmt.Sprintf("Total metrics received with a null value"),
+		},
+		siteLabels,
+	)
+
+	log.Debugf(NewMetricString, SPEdgeNodeOnline)
+
+	e.gaugeMetrics[SPEdgeNodeOnline] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: SPEdgeNodeOnline,
+			Help: fmt.Sprintf("Whether the edge node is online (NBIRTH) or offline (NDEATH)"),
+		},
+		edgeNodeLabels,
+	)
+
+	log.Debugf(NewMetricString, SPDeviceOnline)
+
+	e.gaugeMetrics[SPDeviceOnline] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: SPDeviceOnline,
+			Help: fmt.Sprintf("Whether the device is online (DBIRTH) or offline (DDEATH)"),
+		},
+		siteLabels,
+	)
+
 	log.Debugf(NewMetricString, SPConnectionCount)
 
 	e.counterMetrics[SPConnectionCount] = prometheus.NewCounterVec(
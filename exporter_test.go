@@ -0,0 +1,185 @@
+package main
+
+import (
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// The flags only get their defaults once they are parsed
+func TestMain(m *testing.M) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		log.Fatal(err)
+	}
+
+	// Every exported sample is logged at info level
+	if err := log.Base().SetLevel("warn"); err != nil {
+		log.Fatal(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+func newTestExporter() *spplugExporter {
+	e := &spplugExporter{}
+	e.initializeMetricsAndData()
+	edgeNodeList = make(map[string]*edgeNode)
+
+	return e
+}
+
+func newTestSource(t *testing.T, topic string) *metricSource {
+	spTopic, err := parseTopic(topic)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	siteLabels, siteLabelValues := prepareLabelsAndValues(spTopic)
+	node := newEdgeNode(spTopic.namespace, spTopic.group, spTopic.nodeID)
+
+	return &metricSource{
+		topic:           spTopic,
+		node:            node,
+		deviceID:        spTopic.deviceID,
+		siteLabels:      siteLabels,
+		siteLabelValues: siteLabelValues,
+	}
+}
+
+func newFloatMetric(name string, value float32) *pb.Payload_Metric {
+	return &pb.Payload_Metric{
+		Name:     proto.String(name),
+		Datatype: proto.Uint32(PBFloat),
+		Value:    &pb.Payload_Metric_FloatValue{FloatValue: value},
+	}
+}
+
+func setProperty(metric *pb.Payload_Metric, key string,
+	value *pb.Payload_PropertyValue) {
+
+	if metric.Properties == nil {
+		metric.Properties = &pb.Payload_PropertySet{}
+	}
+
+	metric.Properties.Keys = append(metric.Properties.Keys, key)
+	metric.Properties.Values = append(metric.Properties.Values, value)
+}
+
+// Collects the metric families of the exporter without its own metrics,
+// which need a broker connection
+type familyCollector struct {
+	e *spplugExporter
+}
+
+func (c familyCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c familyCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.e.metrics {
+		m.collect(ch)
+	}
+}
+
+// Gather the exported series as name{label="value",...} value leaving out the
+// topic labels, failing the test if the registry rejects them
+func gatherSeries(t *testing.T, e *spplugExporter) []string {
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(familyCollector{e})
+
+	families, err := registry.Gather()
+
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+
+	var series []string
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var labels []string
+
+			for _, label := range metric.GetLabel() {
+				if label.GetValue() != "" &&
+					!containsLabel(getLabelSet(), label.GetName()) {
+					labels = append(labels,
+						label.GetName()+"=\""+label.GetValue()+"\"")
+				}
+			}
+
+			series = append(series, family.GetName()+"{"+
+				strings.Join(labels, ",")+"} "+
+				strconv.FormatFloat(metric.GetGauge().GetValue(), 'g', -1,
+					64))
+		}
+	}
+
+	sort.Strings(series)
+
+	return series
+}
+
+func TestPrometheusMetricSet(t *testing.T) {
+	defer func(use bool) { *useTimestamps = use }(*useTimestamps)
+
+	now := time.Unix(1600000000, 0)
+	older := now.Add(-time.Minute)
+	newer := now.Add(time.Minute)
+
+	tests := []struct {
+		name          string
+		useTimestamps bool
+		value         float64
+		timestamp     time.Time
+		wantSet       bool
+		wantValue     float64
+		wantTimestamp time.Time
+	}{
+		{"older timestamp ignored", true, 2, older, false, 1, now},
+		{"same timestamp replaces", true, 2, now, true, 2, now},
+		{"newer timestamp replaces", true, 2, newer, true, 2, newer},
+		{"zero timestamp replaces", true, 2, time.Time{}, true, 2,
+			time.Time{}},
+		{"NaN replaces", true, math.NaN(), time.Time{}, true, math.NaN(),
+			time.Time{}},
+		{"older timestamp replaces without timestamps", false, 2, older,
+			true, 2, older},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*useTimestamps = test.useTimestamps
+
+			labelValues := prometheus.Labels{SPGroupID: "G1"}
+			metric := createNewMetric("Temp", SPDefaultHelp,
+				[]string{SPGroupID})
+			metric.set(labelValues, 1, now)
+
+			if got := metric.set(labelValues, test.value,
+				test.timestamp); got != test.wantSet {
+				t.Errorf("set returned %t, want %t", got, test.wantSet)
+			}
+
+			sample := metric.series[getSeriesSignature(labelValues)]
+
+			if sample.value != test.wantValue &&
+				!(math.IsNaN(sample.value) && math.IsNaN(test.wantValue)) {
+				t.Errorf("value %g, want %g", sample.value, test.wantValue)
+			}
+
+			if !sample.timestamp.Equal(test.wantTimestamp) {
+				t.Errorf("timestamp %s, want %s", sample.timestamp,
+					test.wantTimestamp)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// Sparkplug metric names are paths, the folders leading up to the metric
+// (Inverter1/DC/Voltage) are either turned into labels or folded into the
+// metric name depending on the folder mode:
+//
+//   keyvalue    "key:value" folders become key="value" labels
+//   positional  folders become labels named after their position
+//   join        folders are joined into the name, Inverter1_DC_Voltage
+//   drop        folders are ignored
+//
+// The mode can be chosen per group or topic with folder rules.
+
+const (
+	SPFolderLabel string = "sp_folder_"
+)
+
+type folderRule struct {
+	pattern string
+	mode    string
+	labels  []string
+}
+
+var folderRules []folderRule
+
+// Rules are given as <pattern>=<mode>[:<label>,...], a pattern without a
+// slash is matched against the group ID and anything else against the
+// Sparkplug topic (namespace/group/type/node[/device])
+func parseFolderRule(rule string) (folderRule, error) {
+	var r folderRule
+
+	separator := strings.LastIndex(rule, "=")
+
+	if separator <= 0 {
+		return r, fmt.Errorf("folder rule %q: expected <pattern>=<mode>",
+			rule)
+	}
+
+	r.pattern = rule[:separator]
+
+	if _, err := path.Match(r.pattern, ""); err != nil {
+		return r, fmt.Errorf("folder rule %q: %v", rule, err)
+	}
+
+	r.mode = rule[separator+1:]
+
+	if index := strings.Index(r.mode, ":"); index >= 0 {
+		r.labels = splitFolderLabels(r.mode[index+1:])
+		r.mode = r.mode[:index]
+	}
+
+	switch r.mode {
+	case "keyvalue", "positional", "join", "drop":
+	default:
+		return r, fmt.Errorf("folder rule %q: unknown mode %q", rule, r.mode)
+	}
+
+	return r, nil
+}
+
+func splitFolderLabels(labels string) []string {
+	var names []string
+
+	for _, name := range strings.Split(labels, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, sanitizeLabelName(name))
+		}
+	}
+
+	return names
+}
+
+func compileFolderRules(rules []string) error {
+	for _, rule := range rules {
+		r, err := parseFolderRule(rule)
+
+		if err != nil {
+			return err
+		}
+
+		folderRules = append(folderRules, r)
+	}
+
+	return nil
+}
+
+// The first matching rule wins, the flags give the default
+func getFolderRule(t sparkplugTopic) folderRule {
+	for _, rule := range folderRules {
+		subject := t.group
+
+		if strings.Contains(rule.pattern, "/") {
+			subject = t.String()
+		}
+
+		if matched, _ := path.Match(rule.pattern, subject); matched {
+			return rule
+		}
+	}
+
+	return folderRule{
+		mode:   *folderMode,
+		labels: splitFolderLabels(*folderLabels),
+	}
+}
+
+// Name of the label for the folder at the given depth, once the positional
+// names run out it falls back to sp_folder_<depth>
+func (r folderRule) getPositionalLabel(index int) string {
+	if index < len(r.labels) {
+		return r.labels[index]
+	}
+
+	return SPFolderLabel + strconv.Itoa(index+1)
+}
+
+// A folder label must not replace one of the topic labels or an earlier
+// folder
+func addFolderLabel(metricLabels []string,
+	metricLabelValues prometheus.Labels, label string,
+	value string) []string {
+
+	if _, exists := metricLabelValues[label]; exists {
+		log.Debugf("Ignoring folder %s=%s, label already set\n", label, value)
+		return metricLabels
+	}
+
+	metricLabelValues[label] = value
+	return append(metricLabels, label)
+}
+
+// Apply the rule to the folders of a metric, returning the metric name and
+// the label set to export it with
+func (r folderRule) apply(folders []string, metricName string,
+	metricLabels []string, metricLabelValues prometheus.Labels) (string,
+	[]string, prometheus.Labels) {
+
+	if len(folders) == 0 {
+		return metricName, metricLabels, metricLabelValues
+	}
+
+	switch r.mode {
+	case "drop":
+		return metricName, metricLabels, metricLabelValues
+	case "join":
+		joined := make([]string, 0, len(folders)+1)
+
+		for _, folder := range folders {
+			joined = append(joined, sanitizeLabelName(folder))
+		}
+
+		return strings.Join(append(joined, metricName), "_"), metricLabels,
+			metricLabelValues
+	}
+
+	metricLabels = append([]string{}, metricLabels...)
+	metricLabelValues = cloneLabelSet(metricLabelValues)
+
+	for index, folder := range folders {
+		parts := strings.SplitN(folder, ":", 2)
+
+		// Folders that are not key:value pairs are labeled by position
+		// even in keyvalue mode
+		if r.mode == "keyvalue" && len(parts) == 2 {
+			metricLabels = addFolderLabel(metricLabels, metricLabelValues,
+				sanitizeLabelName(parts[0]), parts[1])
+		} else {
+			metricLabels = addFolderLabel(metricLabels, metricLabelValues,
+				r.getPositionalLabel(index), folder)
+		}
+	}
+
+	return metricName, metricLabels, metricLabelValues
+}
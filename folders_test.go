@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestFolderRuleApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		rule       folderRule
+		folders    []string
+		wantName   string
+		wantLabels []string
+		wantValues prometheus.Labels
+	}{
+		{
+			name:       "keyvalue",
+			rule:       folderRule{mode: "keyvalue"},
+			folders:    []string{"site:A", "line:2"},
+			wantName:   "Temp",
+			wantLabels: []string{SPGroupID, "site", "line"},
+			wantValues: prometheus.Labels{SPGroupID: "G1", "site": "A",
+				"line": "2"},
+		},
+		{
+			name:       "keyvalue with a plain folder",
+			rule:       folderRule{mode: "keyvalue"},
+			folders:    []string{"Inverter1", "dc bus:1"},
+			wantName:   "Temp",
+			wantLabels: []string{SPGroupID, SPFolderLabel + "1", "dc_bus"},
+			wantValues: prometheus.Labels{SPGroupID: "G1",
+				SPFolderLabel + "1": "Inverter1", "dc_bus": "1"},
+		},
+		{
+			name:       "positional",
+			rule:       folderRule{mode: "positional", labels: []string{"area"}},
+			folders:    []string{"Inverter1", "DC"},
+			wantName:   "Temp",
+			wantLabels: []string{SPGroupID, "area", SPFolderLabel + "2"},
+			wantValues: prometheus.Labels{SPGroupID: "G1",
+				"area": "Inverter1", SPFolderLabel + "2": "DC"},
+		},
+		{
+			name:       "folder can't override a topic label",
+			rule:       folderRule{mode: "keyvalue"},
+			folders:    []string{SPGroupID + ":other"},
+			wantName:   "Temp",
+			wantLabels: []string{SPGroupID},
+			wantValues: prometheus.Labels{SPGroupID: "G1"},
+		},
+		{
+			name:       "join",
+			rule:       folderRule{mode: "join"},
+			folders:    []string{"Inverter1", "DC:bus"},
+			wantName:   "Inverter1_DC_bus_Temp",
+			wantLabels: []string{SPGroupID},
+			wantValues: prometheus.Labels{SPGroupID: "G1"},
+		},
+		{
+			name:       "drop",
+			rule:       folderRule{mode: "drop"},
+			folders:    []string{"Inverter1", "DC"},
+			wantName:   "Temp",
+			wantLabels: []string{SPGroupID},
+			wantValues: prometheus.Labels{SPGroupID: "G1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			labelValues := prometheus.Labels{SPGroupID: "G1"}
+
+			name, labels, values := test.rule.apply(test.folders, "Temp",
+				[]string{SPGroupID}, labelValues)
+
+			if name != test.wantName {
+				t.Errorf("name %s, want %s", name, test.wantName)
+			}
+
+			if !reflect.DeepEqual(labels, test.wantLabels) {
+				t.Errorf("labels %v, want %v", labels, test.wantLabels)
+			}
+
+			if !reflect.DeepEqual(values, test.wantValues) {
+				t.Errorf("values %v, want %v", values, test.wantValues)
+			}
+
+			// The label values of the message are shared by its metrics
+			if len(labelValues) != 1 {
+				t.Errorf("input labels modified: %v", labelValues)
+			}
+		})
+	}
+}
+
+func TestParseFolderRule(t *testing.T) {
+	rule, err := parseFolderRule("spBv1.0/*/*/Gateway*/*=positional:area, line")
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := folderRule{
+		pattern: "spBv1.0/*/*/Gateway*/*",
+		mode:    "positional",
+		labels:  []string{"area", "line"},
+	}
+
+	if !reflect.DeepEqual(rule, want) {
+		t.Errorf("got %+v, want %+v", rule, want)
+	}
+
+	for _, invalid := range []string{"Site1", "=join", "Site1=flatten",
+		"[=join"} {
+		if _, err := parseFolderRule(invalid); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestGetFolderRule(t *testing.T) {
+	defer func(rules []folderRule, mode string) {
+		folderRules = rules
+		*folderMode = mode
+	}(folderRules, *folderMode)
+
+	folderRules = nil
+	*folderMode = "keyvalue"
+
+	if err := compileFolderRules([]string{"Site1=join",
+		"*/*/*/Gateway*/*=drop"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		topic sparkplugTopic
+		want  string
+	}{
+		{newNodeTopic("spBv1.0", "Site1", msgNDATA, "N1"), "join"},
+		{newDeviceTopic("spBv1.0", "Site2", msgDDATA, "Gateway1", "D1"),
+			"drop"},
+		{newNodeTopic("spBv1.0", "Site2", msgNDATA, "Gateway1"), "keyvalue"},
+	}
+
+	for _, test := range tests {
+		if got := getFolderRule(test.topic).mode; got != test.want {
+			t.Errorf("%s: got %s, want %s", test.topic, got, test.want)
+		}
+	}
+}
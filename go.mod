@@ -8,4 +8,5 @@ require (
 	github.com/prometheus/client_golang v1.7.1
 	github.com/prometheus/common v0.25.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.3.0
 )
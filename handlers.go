@@ -10,6 +10,12 @@ var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
 
 	exporter.client.Subscribe(*topic, 2, exporter.receiveMessage())
 
+	if isPrimaryHost() {
+		exporter.client.Subscribe(getStateTopic(), SPStateQoS,
+			stateMessageHandler)
+		publishState(client, true)
+	}
+
 	_, labelValues := getServiceLabelSetandValues()
 	exporter.counterMetrics[SPConnectionCount].With(labelValues).Inc()
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"unicode/utf8"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+)
+
+// String, Text and UUID metrics can't be a sample value, they are exported
+// as <metric>_info{sp_value="..."} 1 instead.  Only the current string is
+// kept, the series of the previous one is removed when the value changes.
+
+func isStringDatatype(datatype uint32) bool {
+	return datatype == PBString || datatype == PBText || datatype == PBUUID
+}
+
+func getInfoMetricName(metricName string) string {
+	return metricName + "_info"
+}
+
+// Long strings are cut short (on a character boundary) to keep the label
+// values at a reasonable size
+func truncateString(value string, maxLength int) string {
+	if maxLength <= 0 || len(value) <= maxLength {
+		return value
+	}
+
+	value = value[:maxLength]
+
+	for len(value) > 0 && !utf8.ValidString(value) {
+		value = value[:len(value)-1]
+	}
+
+	return value
+}
+
+// Distinct strings currently exported by an info metric across all of its
+// series.  They are taken from the live series so that a value no longer
+// counts once every series holding it has been removed.
+func (e *spplugExporter) getInfoValues(infoName string) map[string]bool {
+	values := make(map[string]bool)
+
+	for _, familyName := range e.getFamilyNames(infoName) {
+		for _, sample := range e.metrics[familyName].series {
+			values[sample.labelValues[SPInfoValue]] = true
+		}
+	}
+
+	return values
+}
+
+// Every new string is a new series, once a metric exports too many distinct
+// values the new ones are dropped to protect Prometheus
+func (e *spplugExporter) isInfoCardinalityExceeded(source *metricSource,
+	infoName string, value string) bool {
+
+	values := e.getInfoValues(infoName)
+
+	if values[value] || len(values) < *stringMaxValues {
+		return false
+	}
+
+	log.Warnf("Dropping value of %s, more than %d distinct values\n",
+		infoName, *stringMaxValues)
+	e.counterMetrics[SPStringCardinalityExceeded].
+		With(source.siteLabelValues).Inc()
+
+	return true
+}
+
+func (e *spplugExporter) exportInfo(source *metricSource,
+	metric *pb.Payload_Metric, metricName string, metricLabels []string,
+	metricLabelValues prometheus.Labels) {
+
+	infoName := getInfoMetricName(metricName)
+	value := truncateString(metric.GetStringValue(), *stringMaxLength)
+
+	key := seriesKey{
+		metricName: infoName,
+		signature:  model.LabelsToSignature(metricLabelValues),
+	}
+
+	infoLabels := append(metricLabels, SPInfoValue)
+	infoLabelValues := cloneLabelSet(metricLabelValues)
+	infoLabelValues[SPInfoValue] = value
+
+	// Historical strings are not the current one
+	if source.historical {
+		if !e.isInfoCardinalityExceeded(source, infoName, value) {
+			e.exportSeries(source, infoName, infoLabels, infoLabelValues, 1)
+		}
+
+		return
+	}
+
+	// The previous string is no longer current, even if the new one ends up
+	// being dropped
+	if previous, exists := e.infoValues[key]; exists && previous != value {
+		previousLabelValues := cloneLabelSet(metricLabelValues)
+		previousLabelValues[SPInfoValue] = previous
+
+		e.deleteSeries(source, infoName, infoLabels, previousLabelValues)
+		delete(e.infoValues, key)
+	}
+
+	if e.isInfoCardinalityExceeded(source, infoName, value) {
+		return
+	}
+
+	e.infoValues[key] = value
+
+	e.exportSeries(source, infoName, infoLabels, infoLabelValues, 1)
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -10,6 +13,10 @@ import (
 )
 
 var (
+	configFile = kingpin.Flag("config.file",
+		"Configuration file holding the metric relabeling rules").
+		Default("").String()
+
 	listenAddress = kingpin.Flag("web.listen-address",
 		"Address on which to expose metrics and web interface").
 		Default(":9337").
@@ -20,6 +27,18 @@ var (
 		Default("/metrics").
 		String()
 
+	adminToken = kingpin.Flag("web.admin-token",
+		"Bearer token required by the admin API, the API is disabled without one").
+		Default("").Envar("SPARKPLUGGW_ADMIN_TOKEN").String()
+
+	commandAllow = kingpin.Flag("web.command-allow",
+		"Regular expression of metric names the command API may write, repeatable").
+		Strings()
+
+	commandAuditFile = kingpin.Flag("web.command-audit-file",
+		"File every command sent through the API is appended to").
+		Default("").String()
+
 	brokerAddress = kingpin.Flag("mqtt.broker-address",
 		"Address of the MQTT broker").
 		Default("tcp://localhost:1883").String()
@@ -39,6 +58,126 @@ var (
 	mqttDebug = kingpin.Flag("mqtt.debug", "Enable MQTT debugging").
 			Default("false").String()
 
+	nodeDeviceID = kingpin.Flag("sparkplug.node-device-id",
+		"Value of the sp_device_id label for edge node (NBIRTH/NDATA) metrics").
+		Default("").String()
+
+	deathPolicy = kingpin.Flag("sparkplug.death-policy",
+		"What to do with the series of an edge node or device once it dies (delete, stale)").
+		Default("delete").Enum("delete", "stale")
+
+	rebirthOnGap = kingpin.Flag("sparkplug.rebirth-on-gap",
+		"Request a rebirth from an edge node when a sequence number is missed").
+		Default("true").Bool()
+
+	hostID = kingpin.Flag("sparkplug.host-id",
+		"Act as the primary host application with this ID, publishing its STATE").
+		Default("").String()
+
+	sparkplugVersion = kingpin.Flag("sparkplug.version",
+		"Sparkplug specification major version (2, 3)").
+		Default("2").Enum("2", "3")
+
+	booleanMode = kingpin.Flag("sparkplug.boolean-mode",
+		"How Boolean metrics are exported: a 0/1 gauge or a state set (gauge, stateset)").
+		Default("gauge").Enum("gauge", "stateset")
+
+	stringMode = kingpin.Flag("sparkplug.string-mode",
+		"How String, Text and UUID metrics are exported: dropped or as *_info series (drop, info)").
+		Default("drop").Enum("drop", "info")
+
+	stringMaxLength = kingpin.Flag("sparkplug.string-max-length",
+		"Strings longer than this are truncated before being used as a label value").
+		Default("128").Int()
+
+	stringMaxValues = kingpin.Flag("sparkplug.string-max-values",
+		"Maximum number of distinct strings exported per *_info metric").
+		Default("100").Int()
+
+	datasetKeyColumn = kingpin.Flag("sparkplug.dataset-key-column",
+		"DataSet column whose value is used as the sp_row label instead of the row index").
+		Default("").String()
+
+	datasetStringColumns = kingpin.Flag("sparkplug.dataset-string-columns",
+		"What to do with non-numeric DataSet columns (drop, label)").
+		Default("drop").Enum("drop", "label")
+
+	templateMode = kingpin.Flag("sparkplug.template-mode",
+		"How members of template instances are named: prefixed with the instance name or labeled (prefix, label)").
+		Default("prefix").Enum("prefix", "label")
+
+	propertyLabels = kingpin.Flag("sparkplug.property-label",
+		"Metric property key (e.g. engUnit) to export as a label, can be repeated").
+		Strings()
+
+	qualityMode = kingpin.Flag("sparkplug.quality-mode",
+		"How the Quality property of a metric is exported: a *_quality gauge, a label or not at all (gauge, label, none)").
+		Default("gauge").Enum("gauge", "label", "none")
+
+	badQuality = kingpin.Flag("sparkplug.bad-quality",
+		"What to do with values of bad quality (keep, drop, stale)").
+		Default("keep").Enum("keep", "drop", "stale")
+
+	useTimestamps = kingpin.Flag("sparkplug.use-timestamps",
+		"Expose samples with the timestamp of their Sparkplug metric (or payload)").
+		Default("false").Bool()
+
+	historicalMode = kingpin.Flag("sparkplug.historical",
+		"What to do with historical (is_historical) metrics: drop them, update the live series or write them to backfill files (drop, live, backfill)").
+		Default("drop").Enum("drop", "live", "backfill")
+
+	backfillDir = kingpin.Flag("sparkplug.backfill-dir",
+		"Directory where OpenMetrics backfill files are written").
+		Default("backfill").String()
+
+	backfillInterval = kingpin.Flag("sparkplug.backfill-interval",
+		"How often buffered historical metrics are written to a backfill file").
+		Default("5m").Duration()
+
+	nullPolicy = kingpin.Flag("sparkplug.null-policy",
+		"What to do with the series of a metric received with a null value (delete, keep)").
+		Default("delete").Enum("delete", "keep")
+
+	rebirthRate = kingpin.Flag("sparkplug.rebirth-rate",
+		"Maximum number of rebirth requests sent per second, across all edge nodes (0 for no limit)").
+		Default("5").Float64()
+
+	rebirthMinInterval = kingpin.Flag("sparkplug.rebirth-min-interval",
+		"Minimum time between rebirth requests to the same edge node, doubled while they go unanswered").
+		Default("1m").Duration()
+
+	rebirthMaxInterval = kingpin.Flag("sparkplug.rebirth-max-interval",
+		"Maximum time between rebirth requests to the same edge node").
+		Default("30m").Duration()
+
+	rebirthStartupJitter = kingpin.Flag("sparkplug.rebirth-startup-jitter",
+		"Rebirth requests for newly seen edge nodes are delayed by a random time up to this").
+		Default("30s").Duration()
+
+	folderMode = kingpin.Flag("sparkplug.folder-mode",
+		"How the folders of a metric path are exported: keyvalue, positional, join or drop").
+		Default("keyvalue").Enum("keyvalue", "positional", "join", "drop")
+
+	folderLabels = kingpin.Flag("sparkplug.folder-labels",
+		"Comma separated label names given to the folders in positional mode").
+		Default("").String()
+
+	folderRuleList = kingpin.Flag("sparkplug.folder-rule",
+		"Folder mode for a group or topic pattern, as <pattern>=<mode>[:<label>,...], repeatable").
+		Strings()
+
+	metricNameMode = kingpin.Flag("sparkplug.metric-name-mode",
+		"Metric names that are not valid in Prometheus are dropped or sanitized").
+		Default("drop").Enum("drop", "sanitize")
+
+	originalNameLabel = kingpin.Flag("sparkplug.original-name-label",
+		"Add the Sparkplug name of every metric as the sp_original_name label").
+		Default("false").Bool()
+
+	labelSchema = kingpin.Flag("sparkplug.label-schema",
+		"Metrics seen with different label sets get the union of their labels, or are split into one metric per label set").
+		Default("union").Enum("union", "split")
+
 	progname = "sparkpluggw"
 	exporter *spplugExporter
 )
@@ -47,10 +186,35 @@ func main() {
 	log.AddFlags(kingpin.CommandLine)
 	kingpin.Parse()
 
+	if err := compileFolderRules(*folderRuleList); err != nil {
+		kingpin.Fatalf("%v", err)
+	}
+
+	if err := compileCommandAllowlist(*commandAllow); err != nil {
+		kingpin.Fatalf("%v", err)
+	}
+
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			kingpin.Fatalf("%v", err)
+		}
+	}
+
 	initSparkPlugExporter(&exporter)
 	prometheus.MustRegister(exporter)
 
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+		sig := <-signals
+		log.Infof("Received %s, shutting down\n", sig)
+		exporter.shutdown()
+		os.Exit(0)
+	}()
+
 	http.Handle(*metricsPath, promhttp.Handler())
+	registerAPIHandlers(http.DefaultServeMux)
 	log.Infoln("Listening on", *listenAddress)
 	err := http.ListenAndServe(*listenAddress, nil)
 	if err != nil {
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// Sparkplug metric names are free text ("Battery Temp", "SOC-%"), with
+// --sparkplug.metric-name-mode=sanitize they are turned into valid Prometheus
+// names instead of being dropped
+
+const (
+	SPOriginalName string = "sp_original_name"
+)
+
+// Replace anything that is not allowed in a metric name with an underscore,
+// collapsing runs of them.  Colons are replaced as well since they are
+// reserved for recording rules, and a leading digit gets an underscore in
+// front.
+func sanitizeMetricName(name string) string {
+	var sanitized strings.Builder
+
+	for _, char := range name {
+		valid := (char >= 'a' && char <= 'z') ||
+			(char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')
+
+		if !valid {
+			char = '_'
+		}
+
+		if char == '_' && strings.HasSuffix(sanitized.String(), "_") {
+			continue
+		}
+
+		sanitized.WriteRune(char)
+	}
+
+	result := strings.Trim(sanitized.String(), "_")
+
+	if result != "" && result[0] >= '0' && result[0] <= '9' {
+		result = "_" + result
+	}
+
+	return result
+}
+
+// Two different source names can end up with the same metric name once
+// sanitized ("SOC-%" and "SOC %", or "Battery Temp" and "Battery_Temp"), the
+// first one seen keeps it.  Returns false if the metric collides with a name that
+// belongs to another source name and can't be told apart by its
+// sp_original_name label.
+func (e *spplugExporter) checkNameCollision(originalName string,
+	metricName string, siteLabelValues prometheus.Labels) bool {
+
+	owner, exists := e.sanitizedNames[metricName]
+
+	if !exists {
+		e.sanitizedNames[metricName] = originalName
+		return true
+	}
+
+	if owner == originalName {
+		return true
+	}
+
+	log.Warnf("Metric %q exported as %s which already belongs to %q\n",
+		originalName, metricName, owner)
+	e.counterMetrics[SPMetricNameCollision].With(siteLabelValues).Inc()
+
+	return *originalNameLabel
+}
+
+// Add the Sparkplug name of the metric as a label
+func addOriginalNameLabel(metric string, metricLabels []string,
+	metricLabelValues prometheus.Labels) ([]string, prometheus.Labels) {
+
+	if !*originalNameLabel {
+		return metricLabels, metricLabelValues
+	}
+
+	metricLabels = append(append([]string{}, metricLabels...), SPOriginalName)
+	metricLabelValues = cloneLabelSet(metricLabelValues)
+	metricLabelValues[SPOriginalName] = metric
+
+	return metricLabels, metricLabelValues
+}
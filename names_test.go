@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestSanitizeMetricName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Battery Temp", "Battery_Temp"},
+		{"SOC-%", "SOC"},
+		{"1st stage", "_1st_stage"},
+		{"a  --  b", "a_b"},
+		{"__leading and trailing__", "leading_and_trailing"},
+		{"rate:5m", "rate_5m"},
+		{"Temp°C", "Temp_C"},
+		{"already_valid", "already_valid"},
+		{"%%", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := sanitizeMetricName(test.name)
+
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+
+			if got != "" && !model.IsValidMetricName(model.LabelValue(got)) {
+				t.Errorf("%q is not a valid metric name", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+)
+
+// Metric properties (PropertySet) describe a metric: engineering units and
+// range, documentation, quality ...  Selected keys become labels, the
+// documentation becomes the HELP text and the engineering range is exported
+// as <metric>_min / <metric>_max.
+
+const (
+	SPPropertyEngLow  string = "engLow"
+	SPPropertyEngHigh string = "engHigh"
+	SPPropertyQuality string = "Quality"
+
+	SPQualityMask uint32 = 0xC0
+
+	SPDefaultHelp string = "Metric pushed via MQTT"
+)
+
+// Properties whose value describes the metric, in order of preference
+var helpPropertyKeys = []string{"Documentation", "Description", "Tooltip"}
+
+// Look up a property, keys are compared case insensitively since edge nodes
+// don't agree on their spelling
+func getProperty(props *pb.Payload_PropertySet,
+	key string) (*pb.Payload_PropertyValue, bool) {
+
+	values := props.GetValues()
+
+	for index, name := range props.GetKeys() {
+		if index < len(values) && strings.EqualFold(name, key) {
+			if values[index].GetIsNull() {
+				return nil, false
+			}
+
+			return values[index], true
+		}
+	}
+
+	return nil, false
+}
+
+func hasProperty(props *pb.Payload_PropertySet, key string) bool {
+	for _, name := range props.GetKeys() {
+		if strings.EqualFold(name, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Complete the properties of a data message with the ones from the birth
+// certificate.  The quality describes the value it came with rather than the
+// metric, so it is never inherited: a data message without one is not bad.
+func inheritProperties(props *pb.Payload_PropertySet,
+	birth *pb.Payload_PropertySet) *pb.Payload_PropertySet {
+
+	if len(birth.GetKeys()) == 0 {
+		return props
+	}
+
+	merged := &pb.Payload_PropertySet{}
+	values := props.GetValues()
+
+	for index, key := range props.GetKeys() {
+		if index < len(values) {
+			merged.Keys = append(merged.Keys, key)
+			merged.Values = append(merged.Values, values[index])
+		}
+	}
+
+	values = birth.GetValues()
+
+	for index, key := range birth.GetKeys() {
+		if index >= len(values) || hasProperty(merged, key) ||
+			strings.EqualFold(key, SPPropertyQuality) {
+			continue
+		}
+
+		merged.Keys = append(merged.Keys, key)
+		merged.Values = append(merged.Values, values[index])
+	}
+
+	return merged
+}
+
+// Some edge nodes send the engineering range as a string
+func convertPropertyToFloat(value *pb.Payload_PropertyValue) (float64,
+	error) {
+
+	if value.GetType() == PBString || value.GetType() == PBText {
+		return strconv.ParseFloat(value.GetStringValue(), 64)
+	}
+
+	return convertValueToFloat(value, value.GetType())
+}
+
+func formatPropertyValue(value *pb.Payload_PropertyValue) string {
+	if isStringDatatype(value.GetType()) {
+		return truncateString(value.GetStringValue(), *stringMaxLength)
+	}
+
+	if propertyVal, err := convertPropertyToFloat(value); err == nil {
+		return strconv.FormatFloat(propertyVal, 'f', -1, 64)
+	}
+
+	return ""
+}
+
+// Add a label for each configured property key, metrics without the property
+// get an empty value so they keep the same label set.  A property must not
+// replace one of the topic or folder labels.
+func addPropertyLabels(props *pb.Payload_PropertySet, metricLabels []string,
+	metricLabelValues prometheus.Labels) ([]string, prometheus.Labels) {
+
+	if len(*propertyLabels) == 0 {
+		return metricLabels, metricLabelValues
+	}
+
+	metricLabelValues = cloneLabelSet(metricLabelValues)
+
+	for _, key := range *propertyLabels {
+		label := sanitizeLabelName(key)
+
+		if _, exists := metricLabelValues[label]; exists {
+			log.Debugf("Ignoring property %s, label already set\n", key)
+			continue
+		}
+
+		metricLabels = append(metricLabels, label)
+		metricLabelValues[label] = ""
+
+		if value, found := getProperty(props, key); found {
+			metricLabelValues[label] = formatPropertyValue(value)
+		}
+	}
+
+	return metricLabels, metricLabelValues
+}
+
+func getPropertyHelp(props *pb.Payload_PropertySet) (string, bool) {
+	for _, key := range helpPropertyKeys {
+		if value, found := getProperty(props, key); found &&
+			value.GetStringValue() != "" {
+			return value.GetStringValue(), true
+		}
+	}
+
+	return "", false
+}
+
+// Remember the documentation of a metric, used as HELP once it is created
+func (e *spplugExporter) storeHelp(metric *pb.Payload_Metric,
+	metricName string) {
+
+	if help, found := getPropertyHelp(metric.GetProperties()); found {
+		e.metricHelp[metricName] = help
+	}
+}
+
+func (e *spplugExporter) getHelp(metricName string) string {
+	if help, exists := e.metricHelp[metricName]; exists {
+		return help
+	}
+
+	return SPDefaultHelp
+}
+
+// The engineering range of a metric as companion gauges
+func (e *spplugExporter) exportLimits(source *metricSource,
+	metric *pb.Payload_Metric, metricName string, metricLabels []string,
+	metricLabelValues prometheus.Labels) {
+
+	limits := map[string]string{
+		SPPropertyEngLow:  metricName + "_min",
+		SPPropertyEngHigh: metricName + "_max",
+	}
+
+	for key, limitName := range limits {
+		value, found := getProperty(metric.GetProperties(), key)
+
+		if !found {
+			continue
+		}
+
+		if limitVal, err := convertPropertyToFloat(value); err == nil {
+			e.exportSeries(source, limitName, metricLabels,
+				metricLabelValues, limitVal)
+		}
+	}
+}
+
+// OPC style quality code from the Quality property, the top two bits tell
+// good (11), uncertain (01) and bad (00) apart, e.g. 192 is good
+func getQuality(props *pb.Payload_PropertySet) (float64, bool) {
+	value, found := getProperty(props, SPPropertyQuality)
+
+	if !found {
+		return float64(0), false
+	}
+
+	quality, err := convertPropertyToFloat(value)
+
+	if err != nil {
+		return float64(0), false
+	}
+
+	return quality, true
+}
+
+func isBadQuality(quality float64) bool {
+	return uint32(quality)&SPQualityMask == 0
+}
+
+// With --sparkplug.quality-mode=label the quality code is a label of the
+// value.  Only the series of the current code is kept, the ones of the
+// previous code (or without a code) are removed when it changes.
+func (e *spplugExporter) addQualityLabel(source *metricSource,
+	metricName string, metricLabels []string,
+	metricLabelValues prometheus.Labels, quality float64,
+	found bool) ([]string, prometheus.Labels) {
+
+	code := ""
+
+	if found {
+		code = strconv.FormatFloat(quality, 'f', -1, 64)
+	}
+
+	if !source.historical {
+		key := seriesKey{
+			metricName: metricName,
+			signature:  model.LabelsToSignature(metricLabelValues),
+		}
+
+		if previous, exists := e.qualityCodes[key]; exists &&
+			previous != code {
+			e.deleteQualitySeries(source, metricName, metricLabelValues,
+				previous)
+		}
+
+		e.qualityCodes[key] = code
+	}
+
+	if !found {
+		return metricLabels, metricLabelValues
+	}
+
+	if _, exists := metricLabelValues[SPQuality]; exists {
+		log.Debugf("Ignoring quality of %s, label already set\n", metricName)
+		return metricLabels, metricLabelValues
+	}
+
+	metricLabelValues = cloneLabelSet(metricLabelValues)
+	metricLabelValues[SPQuality] = code
+
+	return append(metricLabels, SPQuality), metricLabelValues
+}
+
+// Remove the series of a metric exported with a quality code, along with
+// their array elements or states
+func (e *spplugExporter) deleteQualitySeries(source *metricSource,
+	metricName string, metricLabelValues prometheus.Labels, code string) {
+
+	for _, familyName := range e.getFamilyNames(metricName) {
+		family := e.metrics[familyName]
+
+		for signature, sample := range family.series {
+			if sample.labelValues[SPQuality] != code ||
+				!matchLabelValues(sample.labelValues, metricLabelValues) {
+				continue
+			}
+
+			log.Infof("Deleting metric: name (%s) labels: (%s)\n",
+				familyName, sample.labelValues)
+
+			delete(family.series, signature)
+			source.node.untrackSeries(source.deviceID, familyName,
+				sample.labelValues)
+		}
+	}
+}
+
+// Does the label set hold all of the given label values
+func matchLabelValues(labelValues prometheus.Labels,
+	match prometheus.Labels) bool {
+
+	for label, value := range match {
+		if labelValues[label] != value {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	"github.com/golang/protobuf/proto"
+)
+
+func newUIntProperty(value uint32) *pb.Payload_PropertyValue {
+	return &pb.Payload_PropertyValue{
+		Type:  proto.Uint32(PBUInt32),
+		Value: &pb.Payload_PropertyValue_IntValue{IntValue: value},
+	}
+}
+
+func TestQualityLabel(t *testing.T) {
+	defer func(mode string) { *qualityMode = mode }(*qualityMode)
+	*qualityMode = "label"
+
+	e := newTestExporter()
+	source := newTestSource(t, "spBv1.0/G1/DDATA/N1/D1")
+
+	steps := []struct {
+		quality uint32
+		value   float32
+		want    []string
+	}{
+		{192, 20, []string{`Temp_max{} 100`, `Temp{sp_quality="192"} 20`}},
+		{0, 21, []string{`Temp_max{} 100`, `Temp{sp_quality="0"} 21`}},
+		// No quality at all
+		{1, 22, []string{`Temp_max{} 100`, `Temp{} 22`}},
+		{192, 23, []string{`Temp_max{} 100`, `Temp{sp_quality="192"} 23`}},
+	}
+
+	for _, step := range steps {
+		metric := newFloatMetric("Temp", step.value)
+		setProperty(metric, SPPropertyEngHigh, newUIntProperty(100))
+
+		if step.quality != 1 {
+			setProperty(metric, SPPropertyQuality,
+				newUIntProperty(step.quality))
+		}
+
+		e.processMetric(source, metric)
+
+		if got := gatherSeries(t, e); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("value %g: got %v, want %v", step.value, got, step.want)
+		}
+	}
+
+	if len(source.node.getDevice("D1").series) != 2 {
+		t.Errorf("tracking %d series, want 2",
+			len(source.node.getDevice("D1").series))
+	}
+}
+
+func TestPropertyLabels(t *testing.T) {
+	defer func(mode string, labels []string) {
+		*folderMode = mode
+		*propertyLabels = labels
+	}(*folderMode, *propertyLabels)
+
+	*folderMode = "keyvalue"
+	*propertyLabels = []string{"site", "engUnit", "sp_device_id"}
+
+	e := newTestExporter()
+	source := newTestSource(t, "spBv1.0/G1/DDATA/N1/D1")
+
+	metric := newFloatMetric("site:A/Temp", 20)
+	setProperty(metric, "site", &pb.Payload_PropertyValue{
+		Type:  proto.Uint32(PBString),
+		Value: &pb.Payload_PropertyValue_StringValue{StringValue: "B"},
+	})
+	setProperty(metric, "engUnit", &pb.Payload_PropertyValue{
+		Type:  proto.Uint32(PBString),
+		Value: &pb.Payload_PropertyValue_StringValue{StringValue: "C"},
+	})
+
+	e.processMetric(source, metric)
+
+	// The folder and topic labels win over the properties
+	want := []string{`Temp{engUnit="C",site="A"} 20`}
+
+	if got := gatherSeries(t, e); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
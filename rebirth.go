@@ -0,0 +1,279 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// Rebirths (Node Control/Rebirth NCMD) are only requested when we need a
+// fresh birth certificate: the first time an edge node is seen, after a
+// sequence gap, an unknown alias or on manual request.  Requests go through a
+// single worker that is rate limited across all edge nodes, and each edge
+// node backs off (doubling up to a maximum) while its rebirths go unanswered.
+
+const (
+	SPRebirthFirstSight   string = "first sight"
+	SPRebirthSequenceGap  string = "sequence gap"
+	SPRebirthUnknownAlias string = "unknown alias"
+	SPRebirthBirthOrder   string = "data before birth"
+	SPRebirthManual       string = "manual request"
+
+	SPRebirthQueueSize int = 1024
+)
+
+type rebirthState struct {
+	namespace string
+	group     string
+	nodeID    string
+
+	// Queued or waiting on its timer
+	pending  bool
+	timer    *time.Timer
+	reason   string
+	lastSent time.Time
+	backoff  time.Duration
+}
+
+type rebirthScheduler struct {
+	mutex  sync.Mutex
+	e      *spplugExporter
+	nodes  map[string]*rebirthState
+	queue  chan *rebirthState
+	random *rand.Rand
+
+	// Shared by the worker and manual requests, nil when not rate limited
+	limiter <-chan time.Time
+}
+
+func newRebirthScheduler(e *spplugExporter) *rebirthScheduler {
+	s := &rebirthScheduler{
+		e:      e,
+		nodes:  make(map[string]*rebirthState),
+		queue:  make(chan *rebirthState, SPRebirthQueueSize),
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if *rebirthRate > 0 {
+		s.limiter = time.Tick(time.Duration(float64(time.Second) /
+			*rebirthRate))
+	}
+
+	return s
+}
+
+// Wait for our turn under the global rate limit
+func (s *rebirthScheduler) wait() {
+	if s.limiter != nil {
+		<-s.limiter
+	}
+}
+
+func (s *rebirthScheduler) getState(node *edgeNode) *rebirthState {
+	key := edgeNodeKey(node.group, node.nodeID)
+	state, exists := s.nodes[key]
+
+	if !exists {
+		state = &rebirthState{
+			namespace: node.namespace,
+			group:     node.group,
+			nodeID:    node.nodeID,
+		}
+		s.nodes[key] = state
+	}
+
+	return state
+}
+
+// Is the state still the one tracked for its edge node, it is dropped when
+// the edge node goes away
+func (s *rebirthScheduler) isCurrent(state *rebirthState) bool {
+	return s.nodes[edgeNodeKey(state.group, state.nodeID)] == state
+}
+
+// Request a rebirth for the edge node.  Nothing happens if one is already
+// pending, otherwise it is sent once the node's backoff has expired.
+func (s *rebirthScheduler) request(node *edgeNode, reason string) {
+	s.requestAfter(node, reason, 0)
+}
+
+// A node seen for the first time gets a random delay, so that starting up
+// in front of a large fleet does not send all the rebirths at once
+func (s *rebirthScheduler) requestFirstSight(node *edgeNode) {
+	var delay time.Duration
+
+	if *rebirthStartupJitter > 0 {
+		s.mutex.Lock()
+		delay = time.Duration(s.random.Int63n(int64(*rebirthStartupJitter)))
+		s.mutex.Unlock()
+	}
+
+	s.requestAfter(node, SPRebirthFirstSight, delay)
+}
+
+func (s *rebirthScheduler) requestAfter(node *edgeNode, reason string,
+	delay time.Duration) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.getState(node)
+
+	if state.pending {
+		log.Debugf("Rebirth already pending for %s/%s\n", state.group,
+			state.nodeID)
+		return
+	}
+
+	if wait := state.backoff - time.Since(state.lastSent); wait > delay {
+		delay = wait
+	}
+
+	log.Debugf("Rebirth of %s/%s (%s) in %s\n", state.group, state.nodeID,
+		reason, delay)
+
+	state.pending = true
+	state.reason = reason
+	s.schedule(state, delay)
+}
+
+// Queue the state after the delay, must be called with the mutex held
+func (s *rebirthScheduler) schedule(state *rebirthState, delay time.Duration) {
+	if delay <= 0 {
+		s.enqueue(state)
+		return
+	}
+
+	state.timer = time.AfterFunc(delay, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		state.timer = nil
+
+		if s.isCurrent(state) && state.pending {
+			s.enqueue(state)
+		}
+	})
+}
+
+func (s *rebirthScheduler) enqueue(state *rebirthState) {
+	select {
+	case s.queue <- state:
+	default:
+		log.Warnf("Rebirth queue full, dropping request for %s/%s\n",
+			state.group, state.nodeID)
+		state.pending = false
+	}
+}
+
+// The edge node published its birth certificate, which is what a pending
+// rebirth would have asked for, so it is cancelled and the backoff starts over
+func (s *rebirthScheduler) birth(node *edgeNode) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state, exists := s.nodes[edgeNodeKey(node.group, node.nodeID)]
+
+	if !exists {
+		return
+	}
+
+	if state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+
+	// Already queued entries are skipped by the worker
+	state.pending = false
+
+	if state.backoff > *rebirthMinInterval {
+		state.backoff = *rebirthMinInterval
+	}
+}
+
+// The edge node went away, cancel anything pending for it
+func (s *rebirthScheduler) forget(node *edgeNode) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := edgeNodeKey(node.group, node.nodeID)
+
+	if state, exists := s.nodes[key]; exists {
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+
+		delete(s.nodes, key)
+	}
+}
+
+// Send a rebirth for manual requests that want to know the outcome.  The
+// backoff of the edge node is not applied but is updated, the global rate
+// limit is, so a request for a whole fleet can take a while.
+func (s *rebirthScheduler) sendNow(namespace string, group string,
+	nodeID string) bool {
+
+	_, labelValues := getNodeLabelSetandValues(namespace, group, nodeID)
+	s.e.counterMetrics[SPReincarnationManual].With(labelValues).Inc()
+
+	s.wait()
+
+	sent := s.e.sendRebirth(namespace, group, nodeID)
+
+	if sent {
+		s.mutex.Lock()
+
+		if state, exists := s.nodes[edgeNodeKey(group, nodeID)]; exists {
+			state.lastSent = time.Now()
+		}
+
+		s.mutex.Unlock()
+	}
+
+	return sent
+}
+
+// Send the queued rebirths, no faster than the configured rate
+func (s *rebirthScheduler) run() {
+	for state := range s.queue {
+		s.mutex.Lock()
+		current := s.isCurrent(state) && state.pending
+		s.mutex.Unlock()
+
+		// Gone away or born in the meantime
+		if !current {
+			continue
+		}
+
+		s.wait()
+
+		log.Infof("Requesting rebirth of %s/%s (%s)\n", state.group,
+			state.nodeID, state.reason)
+
+		sent := s.e.sendRebirth(state.namespace, state.group, state.nodeID)
+
+		s.mutex.Lock()
+
+		if sent {
+			state.pending = false
+			state.lastSent = time.Now()
+			state.backoff *= 2
+
+			if state.backoff < *rebirthMinInterval {
+				state.backoff = *rebirthMinInterval
+			}
+
+			if state.backoff > *rebirthMaxInterval {
+				state.backoff = *rebirthMaxInterval
+			}
+		} else if s.isCurrent(state) {
+			// Most likely not connected to the broker, try again later
+			s.schedule(state,
+				time.Duration(SPReincarnateRetry)*time.Second)
+		}
+
+		s.mutex.Unlock()
+	}
+}
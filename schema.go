@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+)
+
+// Prometheus requires every series of a metric family to have the same label
+// names, while folders, properties and the like can give the same Sparkplug
+// metric different label sets.  Depending on --sparkplug.label-schema the
+// family either takes the union of all of them, series leaving a label out
+// having it empty, or each label set that differs from the first one gets a
+// family of its own named after its extra labels (Temp_site_line).
+
+// Empty labels are the same as missing ones to Prometheus, so they don't
+// take part in identifying a series.  Otherwise a series created before the
+// label schema grew would clash with one that has the label set to "".
+func getSeriesSignature(labelValues prometheus.Labels) uint64 {
+	labels := make(map[string]string, len(labelValues))
+
+	for key, value := range labelValues {
+		if value != "" {
+			labels[key] = value
+		}
+	}
+
+	return model.LabelsToSignature(labels)
+}
+
+// Add whatever labels the family does not have yet to its schema
+func (m *prometheusmetric) extendLabels(metricName string, help string,
+	metricLabels []string) {
+
+	for _, label := range metricLabels {
+		if !containsLabel(m.promlabel, label) {
+			m.promlabel = append(m.promlabel, label)
+		}
+	}
+
+	m.promdesc = prometheus.NewDesc(metricName, help, m.promlabel, nil)
+}
+
+func containsLabel(labels []string, label string) bool {
+	for _, existing := range labels {
+		if existing == label {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Name of the family split off metricName for a label set, made of the labels
+// the first family of the metric does not have (Temp_site_line) or, failing
+// that, of the ones it lacks (Temp_without_site)
+func getSplitFamilyName(metricName string, base []string,
+	metricLabels []string) string {
+
+	var extra, missing []string
+
+	for _, label := range metricLabels {
+		if !containsLabel(base, label) {
+			extra = append(extra, strings.Trim(label, "_"))
+		}
+	}
+
+	if len(extra) > 0 {
+		return metricName + "_" + strings.Join(extra, "_")
+	}
+
+	for _, label := range base {
+		if !containsLabel(metricLabels, label) {
+			missing = append(missing, strings.Trim(label, "_"))
+		}
+	}
+
+	return metricName + "_without_" + strings.Join(missing, "_")
+}
+
+// Family the metric is exported in for this label set, nil if there is none
+// yet
+func (e *spplugExporter) findFamily(metricName string,
+	metricLabels []string) (string, *prometheusmetric) {
+
+	family, exists := e.metrics[metricName]
+
+	if !exists {
+		return metricName, nil
+	}
+
+	if *labelSchema == "union" ||
+		compareLabelSet(family.promlabel, metricLabels) {
+		return metricName, family
+	}
+
+	for _, name := range e.splitFamilies[metricName] {
+		if compareLabelSet(e.metrics[name].promlabel, metricLabels) {
+			return name, e.metrics[name]
+		}
+	}
+
+	return "", nil
+}
+
+// Find the family for a metric and label set, creating it (or growing its
+// label schema) as needed
+func (e *spplugExporter) getFamily(metricName string,
+	metricLabels []string) (string, *prometheusmetric, string) {
+
+	name, family := e.findFamily(metricName, metricLabels)
+
+	switch {
+	case family == nil && name != "":
+		family = createNewMetric(name, e.getHelp(metricName), metricLabels)
+		e.metrics[name] = family
+		return name, family, "Creating metric"
+	case family != nil && *labelSchema == "union" &&
+		!isSchemaSubset(metricLabels, family.promlabel):
+		family.extendLabels(name, e.getHelp(metricName), metricLabels)
+		return name, family, "Extending label schema of metric"
+	case family != nil:
+		return name, family, "Updating metric"
+	}
+
+	name = getSplitFamilyName(metricName, e.metrics[metricName].promlabel,
+		metricLabels)
+
+	// Another metric could already be using the name
+	for suffix := 2; e.metrics[name] != nil; suffix++ {
+		name = getSplitFamilyName(metricName,
+			e.metrics[metricName].promlabel, metricLabels) + "_" +
+			strconv.Itoa(suffix)
+	}
+
+	log.Infof("Splitting metric %s with labels %s into %s\n", metricName,
+		metricLabels, name)
+
+	family = createNewMetric(name, e.getHelp(metricName), metricLabels)
+	e.metrics[name] = family
+	e.splitFamilies[metricName] = append(e.splitFamilies[metricName], name)
+
+	return name, family, "Creating new timeseries for existing metric"
+}
+
+// Every family a metric is exported in
+func (e *spplugExporter) getFamilyNames(metricName string) []string {
+	if _, exists := e.metrics[metricName]; !exists {
+		return nil
+	}
+
+	return append([]string{metricName}, e.splitFamilies[metricName]...)
+}
+
+func isSchemaSubset(labels []string, schema []string) bool {
+	for _, label := range labels {
+		if !containsLabel(schema, label) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestGetSeriesSignature(t *testing.T) {
+	labels := prometheus.Labels{SPGroupID: "G1", "site": "A"}
+
+	if getSeriesSignature(labels) != getSeriesSignature(
+		prometheus.Labels{SPGroupID: "G1", "site": "A", "area": ""}) {
+		t.Error("an empty label changes the signature")
+	}
+
+	if getSeriesSignature(labels) == getSeriesSignature(
+		prometheus.Labels{SPGroupID: "G1", "site": "B"}) {
+		t.Error("different label values have the same signature")
+	}
+}
+
+func TestLabelSchema(t *testing.T) {
+	defer func(mode string, schema string) {
+		*folderMode = mode
+		*labelSchema = schema
+	}(*folderMode, *labelSchema)
+
+	*folderMode = "keyvalue"
+
+	// The same metric from several devices, with different folder labels
+	updates := []struct {
+		device string
+		name   string
+		value  float32
+	}{
+		{"D1", "site:A/Temp", 1},
+		{"D2", "site:B/area:X/Temp", 2},
+		{"D3", "Temp", 3},
+		{"D1", "site:A/Temp", 4},
+		{"D4", "area:Y/Temp", 5},
+	}
+
+	tests := []struct {
+		schema string
+		want   []string
+	}{
+		{"union", []string{
+			`Temp{area="X",site="B"} 2`,
+			`Temp{area="Y"} 5`,
+			`Temp{site="A"} 4`,
+			`Temp{} 3`,
+		}},
+		{"split", []string{
+			`Temp_area_2{area="Y"} 5`,
+			`Temp_area{area="X",site="B"} 2`,
+			`Temp_without_site{} 3`,
+			`Temp{site="A"} 4`,
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.schema, func(t *testing.T) {
+			*labelSchema = test.schema
+
+			e := newTestExporter()
+
+			for _, update := range updates {
+				source := newTestSource(t,
+					"spBv1.0/G1/DDATA/N1/"+update.device)
+				e.processMetric(source, newFloatMetric(update.name,
+					update.value))
+			}
+
+			if got := gatherSeries(t, e); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
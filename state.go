@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/common/log"
+)
+
+// Primary Host Application support.  Edge nodes configured with a primary
+// host only publish while its STATE topic says it is online.  Sparkplug 2.x
+// uses STATE/<host_id> with a plain ONLINE / OFFLINE payload while 3.0 moved
+// the topic under the namespace and uses a JSON payload.
+
+const (
+	SPStateTopic   string = "STATE"
+	SPNamespaceV3  string = "spBv1.0"
+	SPStateOnline  string = "ONLINE"
+	SPStateOffline string = "OFFLINE"
+	SPStateQoS     byte   = 1
+)
+
+type statePayload struct {
+	Online    bool   `json:"online"`
+	Timestamp uint64 `json:"timestamp"`
+}
+
+// The 3.0 spec requires the OFFLINE will and the ONLINE message to carry the
+// same timestamp, so it is taken once when the exporter starts
+var stateTimestamp = uint64(time.Now().UnixNano() / 1000000)
+
+func isPrimaryHost() bool {
+	return *hostID != ""
+}
+
+func getStateTopic() string {
+	return newStateTopic(*sparkplugVersion, *hostID).String()
+}
+
+func getStatePayload(online bool) []byte {
+	if *sparkplugVersion == "3" {
+		payload, _ := json.Marshal(statePayload{
+			Online:    online,
+			Timestamp: stateTimestamp,
+		})
+		return payload
+	}
+
+	if online {
+		return []byte(SPStateOnline)
+	}
+
+	return []byte(SPStateOffline)
+}
+
+// Is this STATE payload telling everyone that the host is offline
+func isOfflineState(payload []byte) bool {
+	if *sparkplugVersion == "3" {
+		var state statePayload
+
+		if err := json.Unmarshal(payload, &state); err != nil {
+			return false
+		}
+
+		return !state.Online
+	}
+
+	return string(payload) == SPStateOffline
+}
+
+// Register the OFFLINE state as the Last Will, so the broker announces our
+// death should we go away without a graceful shutdown
+func setStateWill(options *mqtt.ClientOptions) {
+	options.SetBinaryWill(getStateTopic(), getStatePayload(false),
+		SPStateQoS, true)
+}
+
+func publishState(c mqtt.Client, online bool) bool {
+	topic := getStateTopic()
+
+	token := c.Publish(topic, SPStateQoS, true, getStatePayload(online))
+	token.Wait()
+
+	if token.Error() != nil {
+		log.Warnf("Failed to publish %s: %s\n", topic, token.Error())
+		return false
+	}
+
+	log.Infof("Published %s online=%t\n", topic, online)
+	return true
+}
+
+// Should another client (or a stale will) mark us offline while we are still
+// connected, put the record straight
+func stateMessageHandler(c mqtt.Client, m mqtt.Message) {
+	if isOfflineState(m.Payload()) {
+		go publishState(c, true)
+	}
+}
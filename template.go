@@ -0,0 +1,131 @@
+package main
+
+import (
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// Template instances (UDTs) hold their own metrics and parameters.  Members
+// are exported either prefixed with the instance name (Motor1_Speed) or under
+// their own name with sp_template_instance / sp_template_ref labels.  Nested
+// instances are walked recursively.
+
+// Ignition and Eclipse Tahu publish definitions in a _types_ folder, the
+// instances refer to them by their bare name
+const SPTemplateTypesFolder string = "_types_/"
+
+// Find a member of a template by name
+func findTemplateMetric(template *pb.Payload_Template,
+	name string) *pb.Payload_Metric {
+
+	for _, metric := range template.GetMetrics() {
+		if metric.GetName() == name {
+			return metric
+		}
+	}
+
+	return nil
+}
+
+// Parameters of the instance override the defaults from the definition
+func mergeTemplateParameters(definition *pb.Payload_Template,
+	instance *pb.Payload_Template) []*pb.Payload_Template_Parameter {
+
+	var params []*pb.Payload_Template_Parameter
+	overridden := make(map[string]bool)
+
+	for _, param := range instance.GetParameters() {
+		params = append(params, param)
+		overridden[param.GetName()] = true
+	}
+
+	for _, param := range definition.GetParameters() {
+		if !overridden[param.GetName()] {
+			params = append(params, param)
+		}
+	}
+
+	return params
+}
+
+// Name and labels of a template member, depending on the template mode
+func getTemplateMemberName(instanceName string, memberName string,
+	templateRef string, metricLabels []string,
+	metricLabelValues prometheus.Labels) (string, []string,
+	prometheus.Labels) {
+
+	memberName = sanitizeLabelName(memberName)
+
+	if *templateMode == "prefix" {
+		return instanceName + "_" + memberName, metricLabels,
+			metricLabelValues
+	}
+
+	memberLabelValues := cloneLabelSet(metricLabelValues)
+
+	// Nested instances extend the instance path of their parent
+	if parent, exists := metricLabelValues[SPTemplateInstance]; exists {
+		memberLabelValues[SPTemplateInstance] = parent + "/" + instanceName
+	} else {
+		metricLabels = append(metricLabels, SPTemplateInstance, SPTemplateRef)
+		memberLabelValues[SPTemplateInstance] = instanceName
+	}
+
+	memberLabelValues[SPTemplateRef] = templateRef
+
+	return memberName, metricLabels, memberLabelValues
+}
+
+func (e *spplugExporter) exportTemplate(source *metricSource,
+	template *pb.Payload_Template, metricName string, metricLabels []string,
+	metricLabelValues prometheus.Labels) {
+
+	// Definitions only describe the type, they have no values of their own
+	if template == nil || template.GetIsDefinition() {
+		return
+	}
+
+	templateRef := template.GetTemplateRef()
+	definition, exists := source.node.templates[templateRef]
+
+	if !exists {
+		log.Debugf("No definition %s for template instance %s\n",
+			templateRef, metricName)
+		definition = &pb.Payload_Template{}
+	}
+
+	for _, param := range mergeTemplateParameters(definition, template) {
+		metricVal, err := convertValueToFloat(param, param.GetType())
+
+		if err != nil {
+			continue
+		}
+
+		paramName, paramLabels, paramLabelValues := getTemplateMemberName(
+			metricName, param.GetName(), templateRef, metricLabels,
+			metricLabelValues)
+
+		e.exportSeries(source, paramName, paramLabels, paramLabelValues,
+			metricVal)
+	}
+
+	for _, member := range template.GetMetrics() {
+
+		// Members of an instance may leave their type to the definition
+		if member.Datatype == nil {
+			if defined := findTemplateMetric(definition,
+				member.GetName()); defined != nil {
+				datatype := defined.GetDatatype()
+				member.Datatype = &datatype
+			}
+		}
+
+		memberName, memberLabels, memberLabelValues := getTemplateMemberName(
+			metricName, member.GetName(), templateRef, metricLabels,
+			metricLabelValues)
+
+		e.exportMetric(source, member, memberName, memberLabels,
+			memberLabelValues)
+	}
+}
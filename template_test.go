@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestTemplateDefinitionFolder(t *testing.T) {
+	for _, definitionName := range []string{"_types_/MotorUDT", "MotorUDT"} {
+		t.Run(definitionName, func(t *testing.T) {
+			e := newTestExporter()
+			source := newTestSource(t, "spBv1.0/G1/DDATA/N1/D1")
+
+			source.node.storeTemplates([]*pb.Payload_Metric{{
+				Name:     proto.String(definitionName),
+				Datatype: proto.Uint32(PBTemplate),
+				Value: &pb.Payload_Metric_TemplateValue{
+					TemplateValue: &pb.Payload_Template{
+						IsDefinition: proto.Bool(true),
+						Parameters: []*pb.Payload_Template_Parameter{{
+							Name: proto.String("Poles"),
+							Type: proto.Uint32(PBUInt32),
+							Value: &pb.Payload_Template_Parameter_IntValue{
+								IntValue: 4,
+							},
+						}},
+						Metrics: []*pb.Payload_Metric{
+							newFloatMetric("Speed", 0),
+						},
+					},
+				},
+			}})
+
+			// The member leaves its data type to the definition
+			e.processMetric(source, &pb.Payload_Metric{
+				Name:     proto.String("Motor1"),
+				Datatype: proto.Uint32(PBTemplate),
+				Value: &pb.Payload_Metric_TemplateValue{
+					TemplateValue: &pb.Payload_Template{
+						TemplateRef: proto.String("MotorUDT"),
+						Metrics: []*pb.Payload_Metric{{
+							Name: proto.String("Speed"),
+							Value: &pb.Payload_Metric_FloatValue{
+								FloatValue: 1450,
+							},
+						}},
+					},
+				},
+			})
+
+			want := []string{`Motor1_Poles{} 4`, `Motor1_Speed{} 1450`}
+
+			if got := gatherSeries(t, e); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Sparkplug topics (6.1.3 of the specification) are made of
+//
+//   namespace/group_id/message_type/edge_node_id[/device_id]
+//
+// with the device ID only present on device messages, plus the STATE topic of
+// primary host applications which is STATE/host_id in 2.x and
+// namespace/STATE/host_id since 3.0.
+
+type messageType int
+
+const (
+	msgNBIRTH messageType = iota
+	msgNDEATH
+	msgDBIRTH
+	msgDDEATH
+	msgNDATA
+	msgDDATA
+	msgNCMD
+	msgDCMD
+	msgSTATE
+)
+
+var messageTypeNames = map[messageType]string{
+	msgNBIRTH: "NBIRTH",
+	msgNDEATH: "NDEATH",
+	msgDBIRTH: "DBIRTH",
+	msgDDEATH: "DDEATH",
+	msgNDATA:  "NDATA",
+	msgDDATA:  "DDATA",
+	msgNCMD:   "NCMD",
+	msgDCMD:   "DCMD",
+	msgSTATE:  SPStateTopic,
+}
+
+func (t messageType) String() string {
+	if name, exists := messageTypeNames[t]; exists {
+		return name
+	}
+
+	return fmt.Sprintf("messageType(%d)", int(t))
+}
+
+func parseMessageType(name string) (messageType, bool) {
+	for t, typeName := range messageTypeNames {
+		if typeName == name {
+			return t, true
+		}
+	}
+
+	return 0, false
+}
+
+// Device messages (DBIRTH, DDATA ...) are the ones carrying a device ID
+func (t messageType) isDevice() bool {
+	switch t {
+	case msgDBIRTH, msgDDEATH, msgDDATA, msgDCMD:
+		return true
+	}
+
+	return false
+}
+
+// Births, deaths and data carry the metrics we export, commands are sent by
+// host applications and STATE isn't a protobuf payload at all
+func (t messageType) isMetric() bool {
+	switch t {
+	case msgNBIRTH, msgNDEATH, msgDBIRTH, msgDDEATH, msgNDATA, msgDDATA:
+		return true
+	}
+
+	return false
+}
+
+type sparkplugTopic struct {
+	namespace string
+	group     string
+	msgType   messageType
+	nodeID    string
+	deviceID  string
+
+	// Only set on STATE topics
+	hostID string
+}
+
+func newNodeTopic(namespace string, group string, msgType messageType,
+	nodeID string) sparkplugTopic {
+
+	return sparkplugTopic{
+		namespace: namespace,
+		group:     group,
+		msgType:   msgType,
+		nodeID:    nodeID,
+	}
+}
+
+func newDeviceTopic(namespace string, group string, msgType messageType,
+	nodeID string, deviceID string) sparkplugTopic {
+
+	t := newNodeTopic(namespace, group, msgType, nodeID)
+	t.deviceID = deviceID
+	return t
+}
+
+// The STATE topic depends on the Sparkplug version we are running as
+func newStateTopic(version string, hostID string) sparkplugTopic {
+	t := sparkplugTopic{msgType: msgSTATE, hostID: hostID}
+
+	if version == "3" {
+		t.namespace = SPNamespaceV3
+	}
+
+	return t
+}
+
+func (t sparkplugTopic) String() string {
+	if t.msgType == msgSTATE {
+		if t.namespace == "" {
+			return SPStateTopic + "/" + t.hostID
+		}
+
+		return t.namespace + "/" + SPStateTopic + "/" + t.hostID
+	}
+
+	topic := t.namespace + "/" + t.group + "/" + t.msgType.String() + "/" +
+		t.nodeID
+
+	if t.msgType.isDevice() {
+		topic += "/" + t.deviceID
+	}
+
+	return topic
+}
+
+// Topic elements can't be empty or contain MQTT wildcards, the separator is
+// taken care of by splitting on it
+func validateTopicElement(element string, name string) error {
+	if element == "" {
+		return fmt.Errorf("empty %s", name)
+	}
+
+	if strings.ContainsAny(element, "+#") {
+		return fmt.Errorf("%s %q contains a wildcard", name, element)
+	}
+
+	return nil
+}
+
+// Strip the configured prefix that the broker (or a bridge) puts in front of
+// the Sparkplug topic
+func trimTopicPrefix(topic string) string {
+	t := strings.TrimPrefix(topic, *prefix)
+	return strings.TrimPrefix(t, "/")
+}
+
+func parseTopic(topic string) (sparkplugTopic, error) {
+	var t sparkplugTopic
+
+	parts := strings.Split(topic, "/")
+
+	// 2.x STATE/host_id
+	if parts[0] == SPStateTopic {
+		if len(parts) != 2 {
+			return t, fmt.Errorf("topic %s: STATE needs 2 elements, got %d",
+				topic, len(parts))
+		}
+
+		t.msgType = msgSTATE
+		t.hostID = parts[1]
+
+		if err := validateTopicElement(t.hostID, "host ID"); err != nil {
+			return t, fmt.Errorf("topic %s: %v", topic, err)
+		}
+
+		return t, nil
+	}
+
+	if len(parts) < 3 {
+		return t, fmt.Errorf("topic %s: too short for a Sparkplug topic",
+			topic)
+	}
+
+	t.namespace = parts[0]
+
+	if err := validateTopicElement(t.namespace, "namespace"); err != nil {
+		return t, fmt.Errorf("topic %s: %v", topic, err)
+	}
+
+	// 3.0 namespace/STATE/host_id
+	if parts[1] == SPStateTopic {
+		if len(parts) != 3 {
+			return t, fmt.Errorf("topic %s: STATE needs 3 elements, got %d",
+				topic, len(parts))
+		}
+
+		t.msgType = msgSTATE
+		t.hostID = parts[2]
+
+		if err := validateTopicElement(t.hostID, "host ID"); err != nil {
+			return t, fmt.Errorf("topic %s: %v", topic, err)
+		}
+
+		return t, nil
+	}
+
+	msgType, known := parseMessageType(parts[2])
+
+	if !known || msgType == msgSTATE {
+		return t, fmt.Errorf("topic %s: unknown message type %q", topic,
+			parts[2])
+	}
+
+	t.msgType = msgType
+	expectedParts := 4
+
+	if msgType.isDevice() {
+		expectedParts = 5
+	}
+
+	if len(parts) != expectedParts {
+		return t, fmt.Errorf("topic %s: %s needs %d elements, got %d", topic,
+			msgType, expectedParts, len(parts))
+	}
+
+	t.group = parts[1]
+	t.nodeID = parts[3]
+
+	if err := validateTopicElement(t.group, "group ID"); err != nil {
+		return t, fmt.Errorf("topic %s: %v", topic, err)
+	}
+
+	if err := validateTopicElement(t.nodeID, "edge node ID"); err != nil {
+		return t, fmt.Errorf("topic %s: %v", topic, err)
+	}
+
+	if msgType.isDevice() {
+		t.deviceID = parts[4]
+
+		if err := validateTopicElement(t.deviceID, "device ID"); err != nil {
+			return t, fmt.Errorf("topic %s: %v", topic, err)
+		}
+	}
+
+	return t, nil
+}
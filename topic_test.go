@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  sparkplugTopic
+	}{
+		{"spBv1.0/G1/NBIRTH/N1",
+			newNodeTopic("spBv1.0", "G1", msgNBIRTH, "N1")},
+		{"spBv1.0/G1/NDATA/N1",
+			newNodeTopic("spBv1.0", "G1", msgNDATA, "N1")},
+		{"spBv1.0/G1/DDATA/N1/D1",
+			newDeviceTopic("spBv1.0", "G1", msgDDATA, "N1", "D1")},
+		{"spBv1.0/G1/DCMD/N1/D1",
+			newDeviceTopic("spBv1.0", "G1", msgDCMD, "N1", "D1")},
+		{"STATE/host1", newStateTopic("2", "host1")},
+		{"spBv1.0/STATE/host1", newStateTopic("3", "host1")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.topic, func(t *testing.T) {
+			got, err := parseTopic(test.topic)
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+
+			// Building the topic back gives the same string
+			if got.String() != test.topic {
+				t.Errorf("String() = %s, want %s", got.String(), test.topic)
+			}
+		})
+	}
+}
+
+func TestParseTopicErrors(t *testing.T) {
+	tests := []struct {
+		topic string
+		error string
+	}{
+		{"foo", "too short"},
+		{"prometheus/foo", "too short"},
+		{"spBv1.0/G1/NSTUFF/N1", "unknown message type"},
+		{"spBv1.0/G1/DDATA/N1", "DDATA needs 5 elements"},
+		{"spBv1.0/G1/NDATA/N1/D1", "NDATA needs 4 elements"},
+		{"spBv1.0//NDATA/N1", "empty group ID"},
+		{"spBv1.0/G1/DDATA/N1/", "empty device ID"},
+		{"spBv1.0/G1/NDATA/+", "contains a wildcard"},
+		{"STATE/host1/extra", "STATE needs 2 elements"},
+		{"spBv1.0/STATE/", "empty host ID"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.topic, func(t *testing.T) {
+			_, err := parseTopic(test.topic)
+
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if !strings.Contains(err.Error(), test.error) {
+				t.Errorf("error %q does not mention %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestMessageType(t *testing.T) {
+	for _, name := range []string{"NBIRTH", "NDEATH", "DBIRTH", "DDEATH",
+		"NDATA", "DDATA", "NCMD", "DCMD", "STATE"} {
+
+		msgType, known := parseMessageType(name)
+
+		if !known || msgType.String() != name {
+			t.Errorf("%s parsed as %v", name, msgType)
+		}
+	}
+
+	if !msgDDEATH.isDevice() || msgNDEATH.isDevice() {
+		t.Error("only D* messages carry a device")
+	}
+
+	if msgNCMD.isMetric() || msgSTATE.isMetric() || !msgNBIRTH.isMetric() {
+		t.Error("only births, deaths and data carry metrics")
+	}
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
+	"math"
 	"strings"
+	"time"
 
 	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
-	"github.com/prometheus/common/model"
 )
 
 // contants for various SP labels and metric names
@@ -20,6 +22,15 @@ const (
 	SPDeviceID   string = "sp_device_id"
 	SPMQTTTopic  string = "sp_mqtt_topic"
 	SPMQTTServer string = "sp_mqtt_server"
+	SPArrayIndex string = "sp_array_index"
+	SPInfoValue  string = "sp_value"
+	SPDataSetRow string = "sp_row"
+
+	SPTemplateInstance string = "sp_template_instance"
+	SPTemplateRef      string = "sp_template_ref"
+	SPQuality          string = "sp_quality"
+
+	SPBdSeqMetric string = "bdSeq"
 )
 
 func sendMQTTMsg(c mqtt.Client, pbMsg *pb.Payload,
@@ -36,6 +47,11 @@ func sendMQTTMsg(c mqtt.Client, pbMsg *pb.Payload,
 	token.Wait()
 	log.Debugf("%s\n", pbMsg.String())
 
+	if token.Error() != nil {
+		log.Warnf("Failed to publish %s: %s\n", topic, token.Error())
+		return false
+	}
+
 	return true
 }
 
@@ -53,83 +69,59 @@ func cloneLabelSet(labels prometheus.Labels) prometheus.Labels {
 // number of entries and the exact same entries orthogonal or the order
 // that they are stored
 
-func compareLabelSet(metricSet []prometheusmetric,
-	newLabels []string) (bool, int) {
-	returnCode := false
-	returnIndex := 0
-	tmpIndex := 0
-	for _, existingMetric := range metricSet {
-
-		// Make sure that both label sets have the same number of entries
-		if len(existingMetric.promlabel) == len(newLabels) {
-
-			// Initially we believe all labeles are unverified
-			// As we verify we decrement, if we end up with something > 0
-			// we know the set does not match
-
-			mismatchedLabels := len(newLabels)
-
-			for _, newLabel := range newLabels {
-				// Compare the current new label to everything in existing
-				// label set
-				for _, existingLabel := range existingMetric.promlabel {
-					if existingLabel == newLabel {
-						mismatchedLabels--
-						break
-					}
-				}
-			}
+func compareLabelSet(existingLabels []string, newLabels []string) bool {
+	// Make sure that both label sets have the same number of entries
+	if len(existingLabels) != len(newLabels) {
+		return false
+	}
+
+	// Initially we believe all labeles are unverified
+	// As we verify we decrement, if we end up with something > 0
+	// we know the set does not match
+
+	mismatchedLabels := len(newLabels)
 
-			if mismatchedLabels == 0 {
-				returnCode = true
-				returnIndex = tmpIndex
+	for _, newLabel := range newLabels {
+		// Compare the current new label to everything in existing
+		// label set
+		for _, existingLabel := range existingLabels {
+			if existingLabel == newLabel {
+				mismatchedLabels--
+				break
 			}
 		}
+	}
+
+	return mismatchedLabels == 0
+}
 
-		tmpIndex++
+// Does labels hold every label of subset with the same value
+func isLabelSubset(subset prometheus.Labels, labels prometheus.Labels) bool {
+	for key, value := range subset {
+		if labels[key] != value {
+			return false
+		}
 	}
-	return returnCode, returnIndex
+
+	return true
 }
 
-func createNewMetric(metricName string, metricLabels []string) *prometheus.GaugeVec {
+func createNewMetric(metricName string, help string,
+	metricLabels []string) *prometheusmetric {
 	var newMetric prometheusmetric
 
-	newMetric.prommetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: metricName,
-			Help: "Metric pushed via MQTT",
-		},
-		metricLabels,
-	)
-	return newMetric.prommetric
-}
-
-func prepareLabelsAndValues(topic string) ([]string, prometheus.Labels, bool) {
-	var labels []string
-	t := strings.TrimPrefix(topic, *prefix)
-	t = strings.TrimPrefix(t, "/")
-	parts := strings.Split(t, "/")
-	
-	// 6.1.3 covers 9 message types, only process device data
-	// Sparkplug puts 5 key namespacing elements in the topic name
-	// these are being parsed and will be added as metric labels
-
-	if (parts[2] == "DDATA") || (parts[2] == "DBIRTH") {
-		if len(parts) != 5 {
-			log.Debugf("Ignoring topic %s, does not comply with Sparkspec\n", t)
-			return nil, nil, false
-		}
-	} else {
-		log.Debugf("Ignoring non-device metric data: %s\n", parts[2])
-		return nil, nil, false
-	}
+	newMetric.promdesc = prometheus.NewDesc(metricName, help, metricLabels,
+		nil)
+	newMetric.promlabel = append(newMetric.promlabel, metricLabels...)
+	newMetric.series = make(map[uint64]*promsample)
 
+	return &newMetric
+}
+
+func prepareLabelsAndValues(t sparkplugTopic) ([]string, prometheus.Labels) {
 	/* See the sparkplug definition for the topic construction */
 	/** Set the Prometheus labels to their corresponding topic part **/
-	if labels == nil {
-		labels = getLabelSet()
-	}
-
+	labels := getLabelSet()
 	labelValues := prometheus.Labels{}
 
 	// Labels are created from the topic parsing above and compared against
@@ -140,12 +132,19 @@ func prepareLabelsAndValues(topic string) ([]string, prometheus.Labels, bool) {
 	// The logic for this is that the same metric name could used across
 	// topics (same metric posted for different devices)
 
-	labelValues[SPNamespace] = parts[0]
-	labelValues[SPGroupID] = parts[1]
-	labelValues[SPEdgeNodeID] = parts[3]
-	labelValues[SPDeviceID] = parts[4]
+	labelValues[SPNamespace] = t.namespace
+	labelValues[SPGroupID] = t.group
+	labelValues[SPEdgeNodeID] = t.nodeID
 
-	return labels, labelValues, true
+	// Node level metrics share the label set of device metrics, the device
+	// label is left empty unless a placeholder has been configured
+	if t.msgType.isDevice() {
+		labelValues[SPDeviceID] = t.deviceID
+	} else {
+		labelValues[SPDeviceID] = *nodeDeviceID
+	}
+
+	return labels, labelValues
 }
 
 func getLabelSet() []string {
@@ -178,11 +177,29 @@ func getNodeLabelSetandValues(namespace string, group string,
 func getNodeLabelSet() []string {
 	return []string{SPNamespace, SPGroupID, SPEdgeNodeID}
 }
-// This function acceptys MQTT metric message,
-// extracts out the nested folders(if any), add those folder names in Key value labels
-// and return label value sets, metrics wrt to those labelvalues and error(if any)
-func getMetricName(metric *pb.Payload_Metric) ([]string, string, error) {
-	var errUnexpectedType error
+
+// Find the bdSeq metric in an NBIRTH or NDEATH payload.  The spec has it as
+// a UInt64 but some edge nodes send a smaller integer type.
+func getBdSeq(metrics []*pb.Payload_Metric) (uint64, bool) {
+	for _, metric := range metrics {
+		if metric.GetName() != SPBdSeqMetric {
+			continue
+		}
+
+		switch metric.GetValue().(type) {
+		case *pb.Payload_Metric_LongValue:
+			return metric.GetLongValue(), true
+		case *pb.Payload_Metric_IntValue:
+			return uint64(metric.GetIntValue()), true
+		}
+	}
+
+	return 0, false
+}
+
+// Split the metric path into its folders and name, the name is only checked
+// once the folder rule had its say
+func getMetricName(metric *pb.Payload_Metric) ([]string, string) {
 	var labelvalues []string
 
 	metricName := metric.GetName()
@@ -197,52 +214,240 @@ func getMetricName(metric *pb.Payload_Metric) ([]string, string, error) {
 		}
 		log.Debugf("Received message for labelvalues: %s\n", labelvalues)
 	}
-	metricNameL := model.LabelValue(metricName)
 
-	if model.IsValidMetricName(metricNameL) == true {
-		errUnexpectedType = nil
-	} else {
-		errUnexpectedType = errors.New("Non-compliant metric name")
-	}
+	return []string(labelvalues), metricName
+}
 
-	return []string(labelvalues), string(metricNameL), errUnexpectedType
+// Value fields shared by metrics, DataSet cells, template parameters and
+// properties, which all encode numbers the same way
+type sparkplugValue interface {
+	GetIntValue() uint32
+	GetLongValue() uint64
+	GetFloatValue() float32
+	GetDoubleValue() float64
+	GetBooleanValue() bool
 }
 
 func convertMetricToFloat(metric *pb.Payload_Metric) (float64, error) {
+	return convertValueToFloat(metric, metric.GetDatatype())
+}
+
+func convertValueToFloat(value sparkplugValue, datatype uint32) (float64,
+	error) {
 	var errUnexpectedType = errors.New("Non-numeric type could not be converted to float")
 
-	switch metric.GetDatatype() {
+	switch datatype {
 	case PBInt8:
-		tmpLong := metric.GetIntValue()
+		tmpLong := value.GetIntValue()
 		tmpSigned := int8(tmpLong)
 		return float64(tmpSigned), nil
 	case PBInt16:
-		tmpLong := metric.GetIntValue()
+		tmpLong := value.GetIntValue()
 		tmpSigned := int16(tmpLong)
 		return float64(tmpSigned), nil
 	case PBInt32:
-		tmpLong := metric.GetIntValue()
+		tmpLong := value.GetIntValue()
 		tmpSigned := int32(tmpLong)
 		return float64(tmpSigned), nil
 	case PBUInt8:
-		return float64(metric.GetIntValue()), nil
+		return float64(value.GetIntValue()), nil
 	case PBUInt16:
-		return float64(metric.GetIntValue()), nil
+		return float64(value.GetIntValue()), nil
 	case PBUInt32:
-		return float64(metric.GetIntValue()), nil
+		return float64(value.GetIntValue()), nil
 	case PBInt64:
 		// This exists because there is an unsigned consersion that
 		// occurs, so moving it to an int64 allows for the sign to work properly
-		tmpLong := metric.GetLongValue()
+		tmpLong := value.GetLongValue()
 		tmpSigned := int64(tmpLong)
 		return float64(tmpSigned), nil
 	case PBUInt64:
-		return float64(metric.GetLongValue()), nil
+		return float64(value.GetLongValue()), nil
 	case PBFloat:
-		return float64(metric.GetFloatValue()), nil
+		return float64(value.GetFloatValue()), nil
 	case PBDouble:
-		return float64(metric.GetDoubleValue()), nil
+		return float64(value.GetDoubleValue()), nil
+	case PBBoolean:
+		if value.GetBooleanValue() {
+			return float64(1), nil
+		}
+		return float64(0), nil
+	case PBDateTime:
+		// Milliseconds since the epoch, Prometheus wants seconds
+		tmpLong := value.GetLongValue()
+		tmpSigned := int64(tmpLong)
+		return float64(tmpSigned) / 1000, nil
 	default:
 		return float64(0), errUnexpectedType
 	}
 }
+
+// Replace anything that is not allowed in a Prometheus label name with an
+// underscore, names can't start with a digit either
+func sanitizeLabelName(name string) string {
+	sanitized := []rune(name)
+
+	for index, char := range sanitized {
+		valid := char == '_' || (char >= 'a' && char <= 'z') ||
+			(char >= 'A' && char <= 'Z') ||
+			(char >= '0' && char <= '9' && index > 0)
+
+		if !valid {
+			sanitized[index] = '_'
+		}
+	}
+
+	if len(sanitized) == 0 {
+		return "_"
+	}
+
+	return string(sanitized)
+}
+
+// Time of a metric's value, the metric may carry its own timestamp otherwise
+// the one of the payload applies.  Zero if neither is set.
+func getMetricTimestamp(metric *pb.Payload_Metric,
+	pbMsg *pb.Payload) time.Time {
+
+	timestamp := pbMsg.GetTimestamp()
+
+	if metric.Timestamp != nil {
+		timestamp = metric.GetTimestamp()
+	}
+
+	if timestamp == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(timestamp)*int64(time.Millisecond))
+}
+
+func isDateTimeDatatype(datatype uint32) bool {
+	return datatype == PBDateTime || datatype == PBDateTimeArray
+}
+
+// DateTime metrics are exported in seconds since the epoch and named
+// accordingly, e.g. last_calibration becomes last_calibration_timestamp_seconds
+func getTimestampMetricName(metricName string) string {
+	switch {
+	case strings.HasSuffix(metricName, "_timestamp_seconds"):
+		return metricName
+	case strings.HasSuffix(metricName, "_timestamp"):
+		return metricName + "_seconds"
+	default:
+		return metricName + "_timestamp_seconds"
+	}
+}
+
+func isArrayDatatype(datatype uint32) bool {
+	return datatype >= PBInt8Array && datatype <= PBDateTimeArray
+}
+
+// Successor to convertMetricToFloat that also understands the Sparkplug 3.0
+// array types, which produce one value per element.  Arrays are only decoded
+// when running in 3.0 mode, every other type yields a single value.
+func convertMetricValues(metric *pb.Payload_Metric) ([]float64, error) {
+	if !isArrayDatatype(metric.GetDatatype()) {
+		value, err := convertMetricToFloat(metric)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return []float64{value}, nil
+	}
+
+	if *sparkplugVersion != "3" {
+		return nil, errors.New("Array types require Sparkplug 3.0")
+	}
+
+	return decodeArray(metric.GetDatatype(), metric.GetBytesValue())
+}
+
+// Array elements are packed little endian one after another, with the
+// exception of Boolean arrays: a 4 byte element count followed by the values
+// packed as bits, most significant bit first.  DateTime elements are
+// milliseconds since the epoch and are converted to seconds.
+func decodeArray(datatype uint32, data []byte) ([]float64, error) {
+	var errMalformed = errors.New("Malformed array value")
+	var size int
+
+	switch datatype {
+	case PBInt8Array, PBUInt8Array:
+		size = 1
+	case PBInt16Array, PBUInt16Array:
+		size = 2
+	case PBInt32Array, PBUInt32Array, PBFloatArray:
+		size = 4
+	case PBInt64Array, PBUInt64Array, PBDoubleArray, PBDateTimeArray:
+		size = 8
+	case PBBooleanArray:
+		return decodeBooleanArray(data)
+	default:
+		return nil, errors.New("Non-numeric array could not be converted to float")
+	}
+
+	if len(data)%size != 0 {
+		return nil, errMalformed
+	}
+
+	values := make([]float64, 0, len(data)/size)
+
+	for offset := 0; offset < len(data); offset += size {
+		element := data[offset : offset+size]
+		var value float64
+
+		switch datatype {
+		case PBInt8Array:
+			value = float64(int8(element[0]))
+		case PBUInt8Array:
+			value = float64(element[0])
+		case PBInt16Array:
+			value = float64(int16(binary.LittleEndian.Uint16(element)))
+		case PBUInt16Array:
+			value = float64(binary.LittleEndian.Uint16(element))
+		case PBInt32Array:
+			value = float64(int32(binary.LittleEndian.Uint32(element)))
+		case PBUInt32Array:
+			value = float64(binary.LittleEndian.Uint32(element))
+		case PBFloatArray:
+			value = float64(math.Float32frombits(
+				binary.LittleEndian.Uint32(element)))
+		case PBInt64Array:
+			value = float64(int64(binary.LittleEndian.Uint64(element)))
+		case PBUInt64Array:
+			value = float64(binary.LittleEndian.Uint64(element))
+		case PBDoubleArray:
+			value = math.Float64frombits(binary.LittleEndian.Uint64(element))
+		case PBDateTimeArray:
+			value = float64(int64(binary.LittleEndian.Uint64(element))) / 1000
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+func decodeBooleanArray(data []byte) ([]float64, error) {
+	if len(data) < 4 {
+		return nil, errors.New("Malformed array value")
+	}
+
+	count := int(binary.LittleEndian.Uint32(data))
+	bits := data[4:]
+
+	if count > len(bits)*8 {
+		return nil, errors.New("Malformed array value")
+	}
+
+	values := make([]float64, count)
+
+	for index := 0; index < count; index++ {
+		if bits[index/8]&(0x80>>uint(index%8)) != 0 {
+			values[index] = 1
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"testing"
+
+	pb "github.com/IHI-Energy-Storage/sparkpluggw/Sparkplug"
+)
+
+func TestConvertMetricToFloat(t *testing.T) {
+	datatype := func(value uint32) *uint32 { return &value }
+
+	tests := []struct {
+		name   string
+		metric *pb.Payload_Metric
+		want   float64
+	}{
+		{
+			name: "boolean true",
+			metric: &pb.Payload_Metric{Datatype: datatype(PBBoolean),
+				Value: &pb.Payload_Metric_BooleanValue{BooleanValue: true}},
+			want: 1,
+		},
+		{
+			name: "boolean false",
+			metric: &pb.Payload_Metric{Datatype: datatype(PBBoolean),
+				Value: &pb.Payload_Metric_BooleanValue{BooleanValue: false}},
+			want: 0,
+		},
+		{
+			name: "negative int8",
+			metric: &pb.Payload_Metric{Datatype: datatype(PBInt8),
+				Value: &pb.Payload_Metric_IntValue{IntValue: 0xFF}},
+			want: -1,
+		},
+		{
+			name: "negative int16",
+			metric: &pb.Payload_Metric{Datatype: datatype(PBInt16),
+				Value: &pb.Payload_Metric_IntValue{IntValue: 0x8000}},
+			want: -32768,
+		},
+		{
+			name: "negative int32",
+			metric: &pb.Payload_Metric{Datatype: datatype(PBInt32),
+				Value: &pb.Payload_Metric_IntValue{IntValue: 0xFFFFFFFE}},
+			want: -2,
+		},
+		{
+			name: "negative int64",
+			metric: &pb.Payload_Metric{Datatype: datatype(PBInt64),
+				Value: &pb.Payload_Metric_LongValue{
+					LongValue: 0xFFFFFFFFFFFFFFFD}},
+			want: -3,
+		},
+		{
+			name: "positive int32",
+			metric: &pb.Payload_Metric{Datatype: datatype(PBInt32),
+				Value: &pb.Payload_Metric_IntValue{IntValue: 42}},
+			want: 42,
+		},
+		{
+			name: "uint8 is not sign extended",
+			metric: &pb.Payload_Metric{Datatype: datatype(PBUInt8),
+				Value: &pb.Payload_Metric_IntValue{IntValue: 0xFF}},
+			want: 255,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := convertMetricToFloat(test.metric)
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != test.want {
+				t.Errorf("got %g, want %g", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConvertMetricToFloatRejectsStrings(t *testing.T) {
+	datatype := PBString
+	metric := &pb.Payload_Metric{Datatype: &datatype,
+		Value: &pb.Payload_Metric_StringValue{StringValue: "RUNNING"}}
+
+	if _, err := convertMetricToFloat(metric); err == nil {
+		t.Error("expected an error for a String metric")
+	}
+}
+
+func TestDecodeArray(t *testing.T) {
+	tests := []struct {
+		name     string
+		datatype uint32
+		data     []byte
+		want     []float64
+	}{
+		{"int8", PBInt8Array, []byte{0x01, 0xFF}, []float64{1, -1}},
+		{"uint8", PBUInt8Array, []byte{0x01, 0xFF}, []float64{1, 255}},
+		{"int16 little endian", PBInt16Array, []byte{0x34, 0x12, 0xFE, 0xFF},
+			[]float64{0x1234, -2}},
+		{"uint32", PBUInt32Array, []byte{0x01, 0x00, 0x00, 0x80},
+			[]float64{0x80000001}},
+		{"float", PBFloatArray, []byte{0x00, 0x00, 0xC0, 0x3F},
+			[]float64{1.5}},
+		{"double", PBDoubleArray,
+			[]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0xC0},
+			[]float64{-2.5}},
+		{"datetime in seconds", PBDateTimeArray,
+			[]byte{0xE8, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			[]float64{1}},
+		{"empty", PBInt32Array, []byte{}, []float64{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeArray(test.datatype, test.data)
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+
+			for index := range got {
+				if got[index] != test.want[index] {
+					t.Errorf("got %v, want %v", got, test.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeArrayMalformed(t *testing.T) {
+	if _, err := decodeArray(PBInt32Array, []byte{0x01, 0x02}); err == nil {
+		t.Error("expected an error for a truncated Int32Array")
+	}
+
+	if _, err := decodeArray(PBStringArray, []byte{}); err == nil {
+		t.Error("expected an error for a StringArray")
+	}
+}
+
+func TestDecodeBooleanArray(t *testing.T) {
+	// 10 values, packed most significant bit first
+	got, err := decodeBooleanArray([]byte{0x0A, 0x00, 0x00, 0x00, 0xA5, 0x80})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []float64{1, 0, 1, 0, 0, 1, 0, 1, 1, 0}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	for index := range got {
+		if got[index] != want[index] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	if _, err := decodeBooleanArray([]byte{0x09, 0x00, 0x00, 0x00,
+		0xFF}); err == nil {
+		t.Error("expected an error when the count exceeds the packed bits")
+	}
+}